@@ -0,0 +1,76 @@
+// Copyright 2024 Sylvain Müller.
+// SPDX-License-Identifier: Apache-2.0
+
+package foxwaf
+
+import (
+	"errors"
+	"fmt"
+	"github.com/corazawaf/coraza/v3/experimental/plugins"
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	"io"
+	"strings"
+	"sync"
+)
+
+// RegisterAuditLogWriter registers under the given name a Coraza audit log writer sending each audit log entry to w,
+// formatted with the SecAuditLogFormat formatter and followed by a newline. Coraza audit log writers are global, so
+// this must be called before building any WAF using it, e.g. from an init function. The writer is selected with the
+// SecAuditLogType directive, for example:
+//
+//	foxwaf.RegisterAuditLogWriter("kafka", producer)
+//	waf, err := coraza.NewWAF(coraza.NewWAFConfig().
+//		WithDirectives("Include @coraza.conf-recommended").
+//		WithDirectives("SecAuditEngine RelevantOnly").
+//		WithDirectives("SecAuditLogType kafka").
+//		WithDirectives("SecAuditLogFormat JSON"))
+//
+// Each WAF selecting the writer gets its own formatter, and writes are serialized across all of them, so w doesn't need
+// to be safe for concurrent use. A WAF has a single audit log writer, so use an io.MultiWriter to keep writing to a
+// file along with w. The names of the Coraza built-in writers ("serial", "concurrent" and "https") are reserved, and
+// this function panics if name is one of them.
+func RegisterAuditLogWriter(name string, w io.Writer) {
+	switch strings.ToLower(name) {
+	case "serial", "concurrent", "https":
+		panic(fmt.Sprintf("foxwaf: audit log writer name %q is reserved by Coraza", name))
+	}
+	mu := new(sync.Mutex)
+	plugins.RegisterAuditLogWriter(name, func() plugintypes.AuditLogWriter {
+		return &auditLogWriter{mu: mu, w: w}
+	})
+}
+
+// auditLogWriter is a Coraza audit log writer sending formatted audit log entries to an io.Writer. The writer and its
+// lock are shared by all the writers registered under the same name.
+type auditLogWriter struct {
+	mu        *sync.Mutex
+	w         io.Writer
+	formatter plugintypes.AuditLogFormatter
+}
+
+func (a *auditLogWriter) Init(c plugintypes.AuditLogConfig) error {
+	if c.Formatter == nil {
+		return errors.New("foxwaf: audit log formatter is required")
+	}
+	a.formatter = c.Formatter
+	return nil
+}
+
+func (a *auditLogWriter) Write(al plugintypes.AuditLog) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	b, err := a.formatter.Format(al)
+	if err != nil {
+		return err
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	_, err = a.w.Write(append(b, '\n'))
+	return err
+}
+
+// Close does not close the underlying writer, which is owned by the caller.
+func (a *auditLogWriter) Close() error {
+	return nil
+}
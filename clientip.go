@@ -0,0 +1,71 @@
+// Copyright 2024 Sylvain Müller.
+// SPDX-License-Identifier: Apache-2.0
+
+package foxwaf
+
+import (
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// trustedProxiesResolver returns a client IP resolver walking the X-Forwarded-For chain right-to-left, as long as the
+// hops are part of the given trusted prefixes, and returning the first untrusted hop. The chain is only considered if
+// the immediate peer is trusted, otherwise, or if the chain is empty or malformed, the remote address is returned.
+func trustedProxiesResolver(prefixes []netip.Prefix) func(r *http.Request) (string, int) {
+	trusted := func(addr netip.Addr) bool {
+		for _, prefix := range prefixes {
+			if prefix.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return func(r *http.Request) (string, int) {
+		client, cport := remoteAddr(r)
+		peer, ok := parseHop(client)
+		if !ok || !trusted(peer) {
+			return client, cport
+		}
+
+		var hops []string
+		for _, v := range r.Header.Values("X-Forwarded-For") {
+			hops = append(hops, strings.Split(v, ",")...)
+		}
+
+		var leftmost netip.Addr
+		for i := len(hops) - 1; i >= 0; i-- {
+			addr, ok := parseHop(hops[i])
+			if !ok {
+				// We can't tell who appended a malformed hop, so nothing beyond the peer can be trusted.
+				return client, cport
+			}
+			if !trusted(addr) {
+				return addr.String(), 0
+			}
+			leftmost = addr
+		}
+
+		// All hops are trusted proxies, the leftmost one is the closest we know to the client.
+		if leftmost.IsValid() {
+			return leftmost.String(), 0
+		}
+		return client, cport
+	}
+}
+
+// parseHop parses an IP address from a remote address or an X-Forwarded-For hop, which may be enclosed in brackets,
+// carry a port or an IPv6 zone. The zone is dropped, as it can't match any prefix.
+func parseHop(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+	if err != nil {
+		addrPort, err := netip.ParseAddrPort(s)
+		if err != nil {
+			return netip.Addr{}, false
+		}
+		addr = addrPort.Addr()
+	}
+	return addr.WithZone("").Unmap(), true
+}
@@ -0,0 +1,83 @@
+// Copyright 2024 Sylvain Müller.
+// SPDX-License-Identifier: Apache-2.0
+
+package foxwaf
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var gzipWriterPool = sync.Pool{
+	New: func() any {
+		return gzip.NewWriter(io.Discard)
+	},
+}
+
+// shouldCompress reports whether the buffered response body is eligible for compression.
+func (w *rwInterceptor) shouldCompress() bool {
+	if !w.cfg.compress || !w.acceptsGzip || w.Size() < w.cfg.compressMinSize {
+		return false
+	}
+	if w.statusCode == http.StatusNoContent || w.statusCode == http.StatusNotModified {
+		return false
+	}
+
+	h := w.w.Header()
+	// The handler already encoded the response.
+	if h.Get("Content-Encoding") != "" {
+		return false
+	}
+	if len(w.cfg.compressTypes) > 0 {
+		return slices.Contains(w.cfg.compressTypes, mediaType(h.Get("Content-Type")))
+	}
+	return true
+}
+
+// compress gzips the buffered response body read from r and sets the response headers accordingly.
+func (w *rwInterceptor) compress(r io.Reader) (io.Reader, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, w.Size()/2))
+	gz := gzipWriterPool.Get().(*gzip.Writer)
+	defer gzipWriterPool.Put(gz)
+
+	gz.Reset(buf)
+	if _, err := io.Copy(gz, r); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+
+	h := w.w.Header()
+	h.Set("Content-Encoding", "gzip")
+	h.Set("Content-Length", strconv.Itoa(buf.Len()))
+	h.Add("Vary", "Accept-Encoding")
+	return buf, nil
+}
+
+// acceptsGzip reports whether the Accept-Encoding header values allow a gzip encoded response.
+func acceptsGzip(values []string) bool {
+	for _, v := range values {
+		for _, part := range strings.Split(v, ",") {
+			coding, params, _ := strings.Cut(part, ";")
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			if coding != "gzip" && coding != "*" {
+				continue
+			}
+			q, found := strings.CutPrefix(strings.TrimSpace(params), "q=")
+			if !found {
+				return true
+			}
+			if weight, err := strconv.ParseFloat(q, 64); err == nil && weight > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,335 @@
+// Copyright 2024 Sylvain Müller.
+// SPDX-License-Identifier: Apache-2.0
+
+package foxwaf
+
+import (
+	"bytes"
+	"context"
+	"github.com/corazawaf/coraza/v3/types"
+	"github.com/tigerwill90/fox"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+type requestInfoKey struct{}
+
+type interruptionKey struct{}
+
+// requestInfo holds the per-request data shared by the middleware with downstream handlers and middlewares. Its
+// presence in the request context means that the request has been cleared by a WAF.
+type requestInfo struct {
+	// waf is the instance which cleared the request, nil if cleared by another layer.
+	waf      *WAF
+	tx       types.Transaction
+	txID     string
+	clientIP string
+	// matchedRules is the number of rules matched during the request phases.
+	matchedRules int
+	// responseInspected and responseReason record whether the response body is inspected, and why not.
+	responseInspected bool
+	responseReason    string
+	// matched is the snapshot of the matched rules taken once the middleware returns, which is when closed is set and
+	// tx is cleared.
+	matched []types.MatchedRule
+	closed  bool
+}
+
+// MarkInspected flags the request held by the context as already cleared by a WAF. Any downstream foxwaf middleware
+// seeing this flag skips processing entirely and calls the next handler. The [WAF] middleware marks the request
+// automatically once it passes inspection, so this is only needed when the request is cleared by another layer
+// (e.g. an edge WAF) that is trusted by the application.
+func MarkInspected(c fox.Context) {
+	if _, ok := requestInfoFrom(c.Request()); !ok {
+		c.SetRequest(withRequestInfo(c.Request(), &requestInfo{}))
+	}
+}
+
+// IsInspected reports whether the request held by the context has already been cleared by a WAF.
+func IsInspected(c fox.Context) bool {
+	_, ok := requestInfoFrom(c.Request())
+	return ok
+}
+
+// ClientIP returns the client IP address passed to Coraza when inspecting the request, so the WAF and the application
+// agree on the client identity. It reports false if the request has not been inspected by the [WAF] middleware.
+func ClientIP(c fox.Context) (string, bool) {
+	info, ok := requestInfoFrom(c.Request())
+	if !ok || info.waf == nil {
+		return "", false
+	}
+	return info.clientIP, true
+}
+
+// TransactionIDFromContext returns the ID of the Coraza transaction which inspected the request, to correlate the
+// response with the audit log entry. It reports false if the request has not been inspected by the [WAF] middleware.
+func TransactionIDFromContext(c fox.Context) (string, bool) {
+	info, ok := requestInfoFrom(c.Request())
+	if !ok || info.waf == nil {
+		return "", false
+	}
+	return info.txID, true
+}
+
+// Transaction returns the live Coraza transaction which inspected the request, so that handlers can call Coraza APIs
+// directly (e.g. to set a variable matched by a response rule). It is the transaction used to process the response,
+// so any change is visible to the response phases. The transaction must not be used once the handler returns, nor
+// closed. It reports false if the request has not been inspected by the [WAF] middleware, or once the transaction
+// has been closed.
+func Transaction(c fox.Context) (types.Transaction, bool) {
+	info, ok := requestInfoFrom(c.Request())
+	if !ok || info.waf == nil || info.closed {
+		return nil, false
+	}
+	return info.tx, true
+}
+
+// MatchedRules returns the number of rules matched during the request phases of the transaction, which is useful to
+// profile rule-heavy paths. It reports false if the request has not been inspected by the [WAF] middleware.
+func MatchedRules(c fox.Context) (int, bool) {
+	info, ok := requestInfoFrom(c.Request())
+	if !ok || info.waf == nil {
+		return 0, false
+	}
+	return info.matchedRules, true
+}
+
+// HighestSeverityRule returns the most severe rule matched so far by the transaction, which lets handlers apply extra
+// scrutiny to suspicious but allowed requests (e.g. with an anomaly score below the blocking threshold). Coraza reports
+// rules without a severity action as emergency, and does not retain the severity action once parsed, so only rules
+// whose actions, as read from the raw rule, explicitly declare a severity are considered. Like MatchedRulesFromContext,
+// this is based on the rules matched so far from the handler, and on all of them once the response has been processed.
+// It reports false if no such rule matched, or if the request has not been inspected by the [WAF] middleware.
+func HighestSeverityRule(c fox.Context) (types.MatchedRule, bool) {
+	info, ok := requestInfoFrom(c.Request())
+	if !ok || info.waf == nil {
+		return nil, false
+	}
+
+	matched := info.matched
+	if !info.closed {
+		matched = info.tx.MatchedRules()
+	}
+
+	var highest types.MatchedRule
+	for _, mr := range matched {
+		if !declaresSeverity(mr.Rule().Raw()) {
+			continue
+		}
+		// The lower the value, the higher the severity.
+		if highest == nil || mr.Rule().Severity() < highest.Rule().Severity() {
+			highest = mr
+		}
+	}
+	return highest, highest != nil
+}
+
+// MatchedRulesFromContext returns the rules matched by the transaction, e.g. for anomaly score logging of requests
+// that passed. From the handler, these are the rules matched so far. Once the response has been processed (e.g. from
+// WithFinalStatus), this is a snapshot of all the rules matched by the transaction, which remains valid after the
+// transaction is closed. It reports false if the request has not been inspected by the [WAF] middleware.
+func MatchedRulesFromContext(c fox.Context) ([]types.MatchedRule, bool) {
+	info, ok := requestInfoFrom(c.Request())
+	if !ok || info.waf == nil {
+		return nil, false
+	}
+	if info.closed {
+		return info.matched, true
+	}
+	return slices.Clone(info.tx.MatchedRules()), true
+}
+
+// ResponseInspected reports whether the response body is buffered for inspection by Coraza or passed through, along
+// with the reason why it is not inspected (e.g. "content type not processable"). The decision is taken when the
+// response status is written, so this is meaningful from the handler once it has written the response, or from
+// callbacks such as WithFinalStatus. It reports false with an empty reason if the request has not been inspected by
+// the [WAF] middleware.
+func ResponseInspected(c fox.Context) (inspected bool, reason string) {
+	info, ok := requestInfoFrom(c.Request())
+	if !ok || info.waf == nil {
+		return false, ""
+	}
+	return info.responseInspected, info.responseReason
+}
+
+// InterruptionFromContext returns the interruption of the transaction, along with the matched rule which caused it and
+// the phase at which it occurred. It is available to the interruption callbacks (e.g. WithBlockResponse or
+// WithOnInterruption), so that they can render a response keyed by the rule tags or category, which are available
+// with Result.Rule.Rule().Tags(). It reports false if the transaction has not been interrupted.
+func InterruptionFromContext(c fox.Context) (Result, bool) {
+	res, ok := c.Request().Context().Value(interruptionKey{}).(*Result)
+	if !ok {
+		return Result{}, false
+	}
+	return *res, true
+}
+
+// withInterruption returns a shallow copy of r carrying the given interruption result.
+func withInterruption(r *http.Request, res *Result) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), interruptionKey{}, res))
+}
+
+// withRequestInfo returns a shallow copy of r carrying the given request info.
+func withRequestInfo(r *http.Request, info *requestInfo) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+}
+
+// requestInfoFrom returns the request info carried by r, if any.
+func requestInfoFrom(r *http.Request) (*requestInfo, bool) {
+	info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo)
+	return info, ok
+}
+
+// FullBodyReader returns a fresh reader over the entire request body, made of the bytes inspected by Coraza (up to the
+// configured request body limit) followed by the remaining bytes that were not inspected, so that a handler can
+// validate the whole body without buffering it a second time. The reader is single-use: unless the body is fully
+// buffered (see WithFullRequestBuffering), it shares the bytes past the inspected ones with the request body, so it
+// must not be combined with reads of the request body. It reports false if the body has not been inspected, or if the
+// inspected bytes are not a prefix of the body, e.g. when parts have been truncated by WithMultipartPartLimit.
+func FullBodyReader(c fox.Context) (io.Reader, bool) {
+	inspected, remainder, ok := inspectedBody(c.Request())
+	if !ok {
+		return nil, false
+	}
+	if buffered, ok := bufferedBodyFrom(c.Request()); ok {
+		return bytes.NewReader(buffered.buf), true
+	}
+	return io.MultiReader(bytes.NewReader(inspected), remainder), true
+}
+
+// InspectedRequestBody returns the request body bytes inspected by Coraza, up to the configured request body limit.
+// It reports false under the same conditions as FullBodyReader.
+func InspectedRequestBody(c fox.Context) ([]byte, bool) {
+	inspected, _, ok := inspectedBody(c.Request())
+	return inspected, ok
+}
+
+// inspectedBody returns the request body bytes inspected by Coraza, along with the reader of the remaining bytes.
+func inspectedBody(req *http.Request) ([]byte, io.Reader, bool) {
+	info, ok := requestInfoFrom(req)
+	if !ok || info.closed {
+		return nil, nil, false
+	}
+	var remainder io.Reader
+	switch body := req.Body.(type) {
+	case reassembledBody:
+		remainder = body.remainder
+	case reassembledBodyWriterTo:
+		remainder = body.remainder
+	}
+	if _, isBuffered := bufferedBodyFrom(req); remainder == nil && !isBuffered {
+		return nil, nil, false
+	}
+
+	rbr, err := info.tx.RequestBodyReader()
+	if err != nil {
+		return nil, nil, false
+	}
+	inspected, err := io.ReadAll(rbr)
+	if err != nil {
+		return nil, nil, false
+	}
+	return inspected, remainder, true
+}
+
+// FullRequestBody returns the entire request body buffered in memory when WithFullRequestBuffering (or
+// WithReplayableBody) is enabled. It reports false if the body has not been buffered. The returned slice is shared
+// with the request body and must not be modified.
+func FullRequestBody(c fox.Context) ([]byte, bool) {
+	if buffered, ok := bufferedBodyFrom(c.Request()); ok {
+		return buffered.buf, true
+	}
+	return nil, false
+}
+
+// ResetBody rewinds the request body buffered in memory by WithReplayableBody (or WithFullRequestBuffering), so that
+// it can be read again from the start, e.g. by a retry layer replaying the request. It reports false if the body has
+// not been buffered, which is the case for bodies exceeding the WithReplayableBody limit, and for any body which is not
+// accessible to Coraza: request body access must be enabled (SecRequestBodyAccess On), and gRPC-Web bodies are never
+// buffered.
+func ResetBody(c fox.Context) bool {
+	buffered, ok := bufferedBodyFrom(c.Request())
+	if !ok {
+		return false
+	}
+	_, _ = buffered.Seek(0, io.SeekStart)
+	return true
+}
+
+// bufferedBodyFrom returns the request body fully buffered in memory, if any.
+func bufferedBodyFrom(r *http.Request) (*bufferedBody, bool) {
+	if body, ok := r.Body.(reassembledBodyWriterTo); ok {
+		if buffered, ok := body.Reader.(*bufferedBody); ok {
+			return buffered, true
+		}
+	}
+	return nil, false
+}
+
+// declaresSeverity reports whether the raw rule declares a severity action. Only the actions of the first directive
+// are considered, since the severity of a chain is declared by its first rule.
+func declaresSeverity(raw string) bool {
+	args := directiveArgs(raw)
+	var actions string
+	switch {
+	case len(args) == 4 && strings.EqualFold(args[0], "SecRule"):
+		actions = args[3]
+	case len(args) == 2 && strings.EqualFold(args[0], "SecAction"):
+		actions = args[1]
+	default:
+		return false
+	}
+
+	var quoted bool
+	start := 0
+	for i := 0; i <= len(actions); i++ {
+		if i < len(actions) {
+			if actions[i] == '\'' {
+				quoted = !quoted
+			}
+			if quoted || actions[i] != ',' {
+				continue
+			}
+		}
+		name, _, _ := strings.Cut(actions[start:i], ":")
+		if strings.EqualFold(strings.TrimSpace(name), "severity") {
+			return true
+		}
+		start = i + 1
+	}
+	return false
+}
+
+// directiveArgs splits the first directive of a raw rule into its name and arguments, up to the actions of a SecRule.
+// Coraza joins continued lines when parsing, so each directive of a chain holds on its own line. Arguments are either
+// double-quoted, with escaped quotes, or bare words.
+func directiveArgs(raw string) []string {
+	line, _, _ := strings.Cut(raw, "\n")
+	var args []string
+	for i := 0; i < len(line) && len(args) < 4; {
+		switch line[i] {
+		case ' ', '\t', '\r':
+			i++
+		case '"':
+			var arg strings.Builder
+			for i++; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' && i+1 < len(line) && line[i+1] == '"' {
+					i++
+				}
+				arg.WriteByte(line[i])
+			}
+			args = append(args, arg.String())
+			i++
+		default:
+			j := strings.IndexAny(line[i:], " \t\r")
+			if j < 0 {
+				j = len(line) - i
+			}
+			args = append(args, line[i:i+j])
+			i += j
+		}
+	}
+	return args
+}
@@ -8,51 +8,94 @@
 package foxwaf
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/corazawaf/coraza/v3"
 	"github.com/corazawaf/coraza/v3/experimental"
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
 	"github.com/corazawaf/coraza/v3/types"
 	"github.com/tigerwill90/fox"
 	"io"
+	"log"
+	"log/slog"
+	"maps"
+	"math/rand/v2"
+	"net"
 	"net/http"
+	"net/netip"
+	"reflect"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
+// ErrNoTransaction is returned when the Coraza WAF fails to create a transaction.
+var ErrNoTransaction = errors.New("foxwaf: failed to create a transaction")
+
 var p = sync.Pool{
 	New: func() any {
 		return &rwInterceptor{}
 	},
 }
 
+var contextReaderPool = sync.Pool{
+	New: func() any {
+		return &contextReader{}
+	},
+}
+
 // Middleware creates a new Fox middleware function using the provided Coraza WAF instance.
 // It intercepts incoming requests and processes them through the WAF before passing them to the next handler.
-func Middleware(waf coraza.WAF) fox.MiddlewareFunc {
-	return NewWAF(waf).Intercept
+func Middleware(waf coraza.WAF, opts ...Option) fox.MiddlewareFunc {
+	return NewWAF(waf, opts...).Intercept
+}
+
+// NewMiddlewareFromConfig creates a new Coraza WAF instance from the provided config and returns a Fox middleware
+// function using it. It returns an error if the WAF cannot be created, e.g. if the directives fail to compile.
+func NewMiddlewareFromConfig(cfg coraza.WAFConfig, opts ...Option) (fox.MiddlewareFunc, error) {
+	waf, err := coraza.NewWAF(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return NewWAF(waf, opts...).Intercept, nil
 }
 
 // WAF struct holds the Coraza WAF instance.
 type WAF struct {
-	waf coraza.WAF
+	waf       coraza.WAF
+	newTX     func(*http.Request) types.Transaction
+	cfg       *config
+	reentrant sync.Once
 }
 
 // NewWAF initializes a new [WAF] middleware with the given Coraza instance.
-func NewWAF(waf coraza.WAF) *WAF {
-	return &WAF{
-		waf: waf,
+func NewWAF(waf coraza.WAF, opts ...Option) *WAF {
+	cfg := defaultConfig()
+	for _, opt := range opts {
+		opt.apply(cfg)
+	}
+	if cfg.wouldBlockHeaders {
+		cfg.wouldBlockStatuses = wouldBlockStatuses(waf, cfg.denyStatus)
+	}
+	if cfg.denyStatus != http.StatusForbidden {
+		cfg.statuslessRules = statuslessRules(waf)
+	}
+	if cfg.ruleExclusions != nil {
+		cfg.ruleTags = ruleTags(waf)
 	}
-}
 
-// Intercept is a middleware function that processes HTTP requests using Coraza WAF.
-// It creates a new transaction for each request, processes the request, and handles any interruptions or responses.
-func (w *WAF) Intercept(next fox.HandlerFunc) fox.HandlerFunc {
+	// Transactions are not pooled by the middleware, since Coraza already recycles them in its own pool once closed.
+	// A second pool would only add a layer of bookkeeping on the request path (see BenchmarkIntercept).
 	newTX := func(*http.Request) types.Transaction {
-		return w.waf.NewTransaction()
+		return waf.NewTransaction()
 	}
 
-	if ctxwaf, ok := w.waf.(experimental.WAFWithOptions); ok {
+	if ctxwaf, ok := waf.(experimental.WAFWithOptions); ok {
 		newTX = func(r *http.Request) types.Transaction {
 			return ctxwaf.NewTransactionWithOptions(experimental.Options{
 				Context: r.Context(),
@@ -60,118 +103,593 @@ func (w *WAF) Intercept(next fox.HandlerFunc) fox.HandlerFunc {
 		}
 	}
 
+	return &WAF{
+		waf:   waf,
+		newTX: newTX,
+		cfg:   cfg,
+	}
+}
+
+// Intercept is a middleware function that processes HTTP requests using Coraza WAF.
+// It creates a new transaction for each request, processes the request, and handles any interruptions or responses.
+func (w *WAF) Intercept(next fox.HandlerFunc) fox.HandlerFunc {
 	return func(c fox.Context) {
+		// Headers are stripped from every response, including the ones not inspected or written by the middleware.
+		if len(w.cfg.stripHeaders) > 0 {
+			sc := c.CloneWith(&stripWriter{ResponseWriter: c.Writer(), names: w.cfg.stripHeaders}, c.Request())
+			defer sc.Close()
+			c = sc
+		}
+
+		// Skipped requests must not pay any WAF cost.
+		if w.cfg.skipper != nil && w.cfg.skipper(c) {
+			next(c)
+			w.reportStatus(c, c.Writer().Status(), false)
+			return
+		}
+
 		req := c.Request()
-		tx := newTX(req)
+		// The request has already been cleared by an upstream WAF, there is no need to inspect it twice.
+		if info, ok := requestInfoFrom(req); ok {
+			if info.waf == w {
+				w.reentrant.Do(func() {
+					log.Printf("foxwaf: middleware applied more than once in the same handler chain, skipping inner instance")
+				})
+				// The final status is reported by the outer instance.
+				next(c)
+				return
+			}
+			next(c)
+			w.reportStatus(c, c.Writer().Status(), false)
+			return
+		}
+
+		// Unsampled requests are neither inspected nor blocked.
+		if w.cfg.samplingRate < 1 && rand.Float64() >= w.cfg.samplingRate {
+			if w.cfg.recorder != nil {
+				w.cfg.recorder.ObserveUnsampledRequest()
+			}
+			next(c)
+			w.reportStatus(c, c.Writer().Status(), false)
+			return
+		}
+
+		start := time.Now()
+		// handlerDuration is the time spent in the next handler, if called.
+		var handlerDuration time.Duration
+
+		client, cport := w.clientAddr(req)
+		// Denied clients are blocked before a transaction is even created.
+		if w.cfg.ipDenylist.contains(client) {
+			status := w.cfg.ipDenyStatus
+			if status == 0 {
+				status = w.cfg.denyStatus
+			}
+			it := &types.Interruption{Action: "deny", Status: status}
+			// The interruption is exposed to the interruption callbacks, with no rule tied to it.
+			c.SetRequest(withInterruption(req, &Result{Interruption: it, Phase: types.PhaseRequestHeaders}))
+			body := w.cfg.blockBodyFor(c, c.Writer().Header(), status, it)
+			if req.Method == http.MethodOptions {
+				w.cfg.setPreflightCORSHeaders(c.Writer().Header())
+			}
+			if w.cfg.tracer != nil {
+				span := w.cfg.tracer.Start(req.Context(), "foxwaf")
+				traceInterruption(span, it, types.PhaseRequestHeaders)
+				span.End()
+			}
+			w.cfg.notifyInterruption(c, it, types.PhaseRequestHeaders)
+			w.writeStatus(c, status, true)
+			if len(body) > 0 {
+				_, _ = c.Writer().Write(body)
+			}
+			return
+		}
+		// Allowlisted clients are trusted, so they bypass the WAF entirely.
+		if w.cfg.ipAllowlist.contains(client) {
+			next(c)
+			w.reportStatus(c, c.Writer().Status(), false)
+			return
+		}
+
+		tx := w.newTX(req)
+		// The WAF is in a bad state, apply the failure policy instead of panicking.
+		if tx == nil {
+			log.Print(ErrNoTransaction)
+			if w.cfg.failClosed {
+				w.writeStatus(c, http.StatusServiceUnavailable, false)
+				return
+			}
+			next(c)
+			w.reportStatus(c, c.Writer().Status(), false)
+			return
+		}
+		// cr is the reader of the request body, pooled unless WithoutInterceptorPool is set. The handler may retain the
+		// body, so the reader is only recycled once the request completes.
+		var cr *contextReader
 		defer func() {
+			if cr != nil {
+				putContextReader(cr)
+			}
+			if w.cfg.logFields != nil {
+				for k, v := range w.cfg.logFields(c) {
+					setTXVariable(tx, k, v)
+				}
+			}
 			// We run phase 5 rules and create audit logs (if enabled)
 			tx.ProcessLogging()
 			// we remove temporary files and free some memory
 			if err := tx.Close(); err != nil {
 				tx.DebugLogger().Error().Err(err).Msg("Failed to close the transaction")
 			}
+			if w.cfg.recorder != nil {
+				w.cfg.recorder.ObserveDuration(handlerDuration, time.Since(start)-handlerDuration)
+				w.cfg.recorder.ObserveMatchedRules(len(tx.MatchedRules()))
+			}
+			if w.cfg.ruleStats != nil {
+				w.cfg.ruleStats.record(tx.MatchedRules())
+			}
 		}()
 
+		if w.cfg.txInit != nil {
+			w.cfg.txInit(req, tx)
+		}
+		if w.cfg.ruleExclusions != nil {
+			ids, tags := w.cfg.ruleExclusions(c)
+			removeRules(tx, ids, tags, w.cfg.ruleTags)
+		}
+		if w.cfg.responseBodyLimit != nil {
+			lowerBodyLimit(tx, "ResponseBodyLimit", w.cfg.responseBodyLimit(c))
+		}
+
+		// Clients exceeding their rate are rejected before any rule processing, whether or not the rule engine is on.
+		limited := w.cfg.rateLimiter != nil && !w.cfg.rateLimiter.allow(client, time.Now())
+
 		// Early return, Coraza is not going to process any rule
-		if tx.IsRuleEngineOff() {
-			next(c)
+		if tx.IsRuleEngineOff() && !limited {
+			handlerStart := time.Now()
+			w.serveNext(next, c)
+			handlerDuration = time.Since(handlerStart)
+			w.reportStatus(c, c.Writer().Status(), false)
 			return
 		}
 
 		// ProcessRequest is just a wrapper around ProcessConnection, ProcessURI,
 		// ProcessRequestHeaders and ProcessRequestBody.
 		// It fails if any of these functions returns an error and it stops on interruption.
-		if it, err := processRequest(tx, req); err != nil {
-			tx.DebugLogger().Error().Err(err).Msg("Failed to process request")
+		var span Span
+		if w.cfg.tracer != nil {
+			span = w.cfg.tracer.Start(req.Context(), "foxwaf")
+			span.SetAttribute("waf.transaction_id", tx.ID())
+			defer span.End()
+		}
+
+		var (
+			it    *types.Interruption
+			phase types.RulePhase
+			err   error
+		)
+		processStart := time.Now()
+		if limited {
+			it, phase = &types.Interruption{Action: "deny", Status: http.StatusTooManyRequests}, types.PhaseRequestHeaders
+		} else {
+			rejectOverLimit := w.cfg.rejectOverLimit != nil && w.cfg.rejectOverLimit(c)
+			if !w.cfg.noPool {
+				cr = contextReaderPool.Get().(*contextReader)
+			}
+			it, phase, err = processRequest(tx, req, client, cport, rejectOverLimit, cr, w.cfg)
+		}
+		requestDuration := time.Since(processStart)
+		if w.cfg.recorder != nil {
+			w.cfg.recorder.ObserveProcessingDuration(types.PhaseRequestBody, requestDuration)
+		}
+		if err != nil {
+			// A malformed chunked body is a client-side protocol error.
+			w.logError(tx, req, client, "Failed to process request", err, isMalformedChunkedEncoding(err) || errors.Is(err, context.Canceled))
+			if w.cfg.errorHandler != nil {
+				w.cfg.errorHandler(c, err)
+				// The client must get a definitive response, even if the error handler only observed the failure.
+				if !c.Writer().Written() {
+					w.writeStatus(c, http.StatusInternalServerError, false)
+					return
+				}
+				w.reportStatus(c, c.Writer().Status(), false)
+				return
+			}
+			if isMalformedChunkedEncoding(err) {
+				w.writeStatus(c, http.StatusBadRequest, false)
+				return
+			}
+			w.writeStatus(c, http.StatusInternalServerError, false)
 			return
-		} else if it != nil {
-			c.Writer().WriteHeader(obtainStatusCodeFromInterruptionOrDefault(it, http.StatusOK))
+		}
+		// The application may veto the request based on the arguments parsed by Coraza.
+		if it == nil && w.cfg.veto != nil {
+			if v := w.cfg.veto(c, requestArgs(tx)); v != nil {
+				tx.DebugLogger().Info().Int("status", v.Status).Msg("Request vetoed")
+				it = &types.Interruption{Action: "deny", Status: v.Status}
+				phase = types.PhaseRequestBody
+			}
+		}
+		if isBlocking(tx, it, w.cfg) {
+			// The interruption is exposed to the interruption callbacks.
+			c.SetRequest(withInterruption(c.Request(), &Result{Interruption: it, Rule: interruptionRule(tx, it), Phase: phase}))
+			if it.Action == "drop" {
+				traceInterruption(span, it, phase)
+				w.cfg.notifyInterruption(c, it, phase)
+				if !dropConnection(c.Writer()) {
+					c.Writer().Header().Set("Content-Length", "0")
+					c.Writer().WriteHeader(statusNoResponse)
+				}
+				w.reportStatus(c, statusNoResponse, true)
+				return
+			}
+
+			status := obtainStatusCodeFromInterruptionOrDefault(it, w.cfg, http.StatusOK)
+			body := w.cfg.blockBodyFor(c, c.Writer().Header(), status, it)
+			if req.Method == http.MethodOptions {
+				w.cfg.setPreflightCORSHeaders(c.Writer().Header())
+			}
+			traceInterruption(span, it, phase)
+			w.cfg.notifyInterruption(c, it, phase)
+			if w.cfg.serverTiming {
+				setServerTiming(c.Writer().Header(), requestDuration, 0)
+			}
+			w.writeStatus(c, status, true)
+			if len(body) > 0 {
+				_, _ = c.Writer().Write(body)
+			}
 			return
 		}
 
-		interceptor := p.Get().(*rwInterceptor)
-		defer p.Put(interceptor)
+		var interceptor *rwInterceptor
+		if w.cfg.noPool {
+			interceptor = &rwInterceptor{}
+		} else {
+			interceptor = p.Get().(*rwInterceptor)
+			defer putInterceptor(interceptor)
+		}
 
-		interceptor.reset(tx, c.Writer(), req.Proto)
-		cc := c.CloneWith(interceptor, req)
+		interceptor.reset(tx, c.Writer(), req, w.cfg)
+		defer interceptor.releaseBuffer()
+		// A non-blocking interruption has been demoted, the transaction is no longer inspected.
+		interceptor.demoted = it != nil
+		info := &requestInfo{
+			waf:            w,
+			tx:             tx,
+			txID:           tx.ID(),
+			clientIP:       client,
+			matchedRules:   len(tx.MatchedRules()),
+			responseReason: reasonNotWritten,
+		}
+		interceptor.info = info
+		// The transaction is closed once the middleware returns, so the matched rules are snapshotted for later use,
+		// and the transaction is no longer reachable from the context.
+		defer func() {
+			info.matched = slices.Clone(tx.MatchedRules())
+			info.closed = true
+			info.tx = nil
+		}()
+		// The request has been cleared, so any downstream foxwaf instance can skip it.
+		cc := c.CloneWith(interceptor, withRequestInfo(req, info))
 		defer cc.Close()
+		interceptor.ctx = cc
+		interceptor.span = span
+		interceptor.requestDuration = requestDuration
+
+		if w.cfg.onClean != nil {
+			w.cfg.onClean(cc)
+		}
 
-		next(cc)
+		handlerStart := time.Now()
+		w.serveNext(next, cc)
+		handlerDuration = time.Since(handlerStart)
 
-		if err := processResponse(tx, interceptor); err != nil {
-			tx.DebugLogger().Error().Err(err).Msg("Failed to close the response")
+		processStart = time.Now()
+		interceptor.responseStart = processStart
+		err = processResponse(tx, interceptor)
+		if w.cfg.recorder != nil {
+			w.cfg.recorder.ObserveProcessingDuration(types.PhaseResponseBody, time.Since(processStart))
+		}
+		if w.cfg.verdictTrailer {
+			interceptor.setVerdictTrailer()
+		}
+		// The status code has been flushed by the response processing, whatever the outcome.
+		w.reportStatus(cc, interceptor.statusCode, interceptor.interrupted())
+		if err != nil {
+			w.logError(tx, req, client, "Failed to close the response", err, false)
+			if w.cfg.errorHandler != nil {
+				w.cfg.errorHandler(cc, err)
+			}
 			return
 		}
 	}
 }
 
+// serveNext calls the next handler, recovering from any panic with the handler configured with WithRecover, if any.
+// The panic is answered with a 500 Internal Server Error, unless the response has already been written.
+func (w *WAF) serveNext(next fox.HandlerFunc, c fox.Context) {
+	if w.cfg.recoverHandler != nil {
+		defer func() {
+			if v := recover(); v != nil {
+				// The handler aborted the response on purpose, so this is not ours to recover.
+				if v == http.ErrAbortHandler {
+					panic(v)
+				}
+				w.cfg.recoverHandler(c, v)
+				if !c.Writer().Written() {
+					c.Writer().WriteHeader(http.StatusInternalServerError)
+				}
+			}
+		}()
+	}
+	next(c)
+}
+
+// logError logs a failure to process the transaction, through the logger configured with WithLogger if any, or the
+// Coraza debug logger otherwise. Failures caused by the client are logged at warn level.
+func (w *WAF) logError(tx types.Transaction, req *http.Request, client, msg string, err error, clientErr bool) {
+	if w.cfg.logger != nil {
+		level := slog.LevelError
+		if clientErr {
+			level = slog.LevelWarn
+		}
+		w.cfg.logger.LogAttrs(
+			req.Context(),
+			level,
+			msg,
+			slog.String("tx_id", tx.ID()),
+			slog.String("client_ip", client),
+			slog.String("method", req.Method),
+			slog.String("path", req.URL.Path),
+			slog.Any("error", err),
+		)
+		return
+	}
+	if clientErr {
+		tx.DebugLogger().Warn().Err(err).Msg(msg)
+		return
+	}
+	tx.DebugLogger().Error().Err(err).Msg(msg)
+}
+
+// writeStatus sends a status code decided by the middleware itself and reports it as final.
+func (w *WAF) writeStatus(c fox.Context, status int, interrupted bool) {
+	c.Writer().WriteHeader(status)
+	w.reportStatus(c, status, interrupted)
+}
+
+// reportStatus invokes the final status callback, if any. It must be called exactly once per transaction, once the
+// status code has been flushed.
+func (w *WAF) reportStatus(c fox.Context, status int, interrupted bool) {
+	if w.cfg.finalStatus != nil {
+		w.cfg.finalStatus(c, status, interrupted)
+	}
+}
+
 // processRequest fills all transaction variables from an http.Request object. Most implementations of Coraza will probably
 // use http.Request objects so this will implement all phase 0, 1 and 2 variables.
 // Note: This function will stop after an interruption
 // Note: Do not manually fill any request variables
-func processRequest(tx types.Transaction, req *http.Request) (*types.Interruption, error) {
-	var (
-		client string
-		cport  int
-	)
-	// IMPORTANT: Some http.Request.RemoteAddr implementations will not contain port or contain IPV6: [2001:db8::1]:8080
-	idx := strings.LastIndexByte(req.RemoteAddr, ':')
-	if idx != -1 {
-		client = req.RemoteAddr[:idx]
-		cport, _ = strconv.Atoi(req.RemoteAddr[idx+1:])
+// The returned phase is the phase at which the request was interrupted, if any.
+// Bodies reaching the Coraza request body limit are rejected if rejectOverLimit is set, see WithRequestBodyLimitReject.
+// The request body is read through cr, which the caller recycles once the request completes, or a new reader if nil.
+func processRequest(tx types.Transaction, req *http.Request, client string, cport int, rejectOverLimit bool, cr *contextReader, cfg *config) (*types.Interruption, types.RulePhase, error) {
+	// Requests carrying both a Content-Length and a Transfer-Encoding are rejected before any inspection.
+	if cfg.rejectAmbiguousBodyFraming && hasAmbiguousBodyFraming(req) {
+		return &types.Interruption{Action: "deny", Status: http.StatusBadRequest}, types.PhaseRequestHeaders, nil
+	}
+
+	// Oversized header blocks are rejected before any inspection, like oversized header values.
+	if cfg.maxHeaderBytes > 0 && headerBlockSize(req) > cfg.maxHeaderBytes {
+		return &types.Interruption{Action: "deny", Status: http.StatusRequestHeaderFieldsTooLarge}, types.PhaseRequestHeaders, nil
+	}
+
+	// Cookie bombs are rejected before Coraza parses the cookies.
+	if cfg.maxCookies > 0 || cfg.maxCookieBytes > 0 {
+		if count, size := cookieStats(req); (cfg.maxCookies > 0 && count > cfg.maxCookies) || (cfg.maxCookieBytes > 0 && size > cfg.maxCookieBytes) {
+			return &types.Interruption{Action: "deny", Status: cfg.cookieDenyStatus}, types.PhaseRequestHeaders, nil
+		}
+	}
+
+	// The GEO collection is only populated by the @geoLookup operator, so we feed it with the provided geo data.
+	if cfg.geoVars != nil {
+		country, asn := cfg.geoVars(req)
+		setGeoVariables(tx, country, asn)
 	}
 
 	var in *types.Interruption
-	// There is no socket access in the request object, so we neither know the server client nor port.
-	tx.ProcessConnection(client, cport, "", 0)
+	// The server address is only known when the request is served by net/http, which exposes the local address of
+	// the connection in the request context.
+	server, sport := localAddr(req)
+	tx.ProcessConnection(client, cport, server, sport)
 	tx.ProcessURI(req.URL.String(), req.Method, req.Proto)
-	for k, vr := range req.Header {
-		for _, v := range vr {
-			tx.AddRequestHeader(k, v)
+	// Ranging over the header map directly avoids allocating the list of names when they don't need to be sorted.
+	if cfg.sortHeaders {
+		for _, k := range slices.Sorted(maps.Keys(req.Header)) {
+			if !addRequestHeader(tx, k, req.Header[k], cfg) {
+				return &types.Interruption{Action: "deny", Status: http.StatusRequestHeaderFieldsTooLarge}, types.PhaseRequestHeaders, nil
+			}
+		}
+	} else {
+		for k, vv := range req.Header {
+			if !addRequestHeader(tx, k, vv, cfg) {
+				return &types.Interruption{Action: "deny", Status: http.StatusRequestHeaderFieldsTooLarge}, types.PhaseRequestHeaders, nil
+			}
 		}
 	}
 
-	// Host will always be removed from req.Headers() and promoted to the
-	// Request.Host field, so we manually add it
+	// Host will always be promoted to the Request.Host field (from the :authority pseudo-header for HTTP/2
+	// requests), so we manually add it
 	if req.Host != "" {
 		tx.AddRequestHeader("Host", req.Host)
 		// This connector relies on the host header (now host field) to populate ServerName
-		tx.SetServerName(req.Host)
+		tx.SetServerName(serverName(req.Host, cfg.stripServerNamePort))
 	}
 
 	// Transfer-Encoding header is removed by go/http
 	// We manually add it to make rules relying on it work (E.g. CRS rule 920171)
-	if req.TransferEncoding != nil {
-		tx.AddRequestHeader("Transfer-Encoding", req.TransferEncoding[0])
+	// All the encodings are joined, as the origin would have seen them.
+	if len(req.TransferEncoding) > 0 {
+		tx.AddRequestHeader("Transfer-Encoding", strings.Join(req.TransferEncoding, ", "))
+	}
+
+	// Bodies without a Content-Type would evade content-type-gated rules, so we assume a default one.
+	if cfg.defaultContentType != "" && hasBody(req) && req.Header.Get("Content-Type") == "" {
+		tx.AddRequestHeader("Content-Type", cfg.defaultContentType)
+	}
+
+	// Go abstracts the raw request line and headers, so they can only be provided by an external source.
+	if cfg.rawRequest != nil {
+		if raw := cfg.rawRequest(req); raw != nil {
+			setTXVariable(tx, rawRequestVariable, string(raw))
+		}
 	}
 
 	in = tx.ProcessRequestHeaders()
 	if in != nil {
-		return in, nil
+		return in, types.PhaseRequestHeaders, nil
+	}
+
+	// State-changing requests from a disallowed origin are rejected as a CSRF backstop.
+	if len(cfg.allowedOrigins) > 0 && !isAllowedOrigin(req, cfg.allowedOrigins) {
+		return &types.Interruption{Action: "deny", Status: cfg.originDenyStatus}, types.PhaseRequestHeaders, nil
+	}
+
+	// An upstream middleware may have consumed the body, leaving a way to obtain a fresh reader over it. A consumed body
+	// can only be told apart when it has been replaced by http.NoBody or nil, as reading it would consume it otherwise.
+	if req.GetBody != nil && (req.Body == nil || req.Body == http.NoBody) {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, types.PhaseUnknown, fmt.Errorf("failed to get a fresh request body: %w", err)
+		}
+		req.Body = body
 	}
 
-	if tx.IsRequestBodyAccessible() {
+	// The body size is capped regardless of how much of it is inspected. Bodies declaring a larger size are rejected
+	// upfront, others fail to be read once the cap is exceeded, either here or in the handler.
+	if cfg.maxBodySize > 0 && hasBody(req) {
+		if req.ContentLength > cfg.maxBodySize {
+			return &types.Interruption{Action: "deny", Status: http.StatusRequestEntityTooLarge}, types.PhaseRequestBody, nil
+		}
+		req.Body = http.MaxBytesReader(nil, req.Body, cfg.maxBodySize)
+	}
+
+	// gRPC-Web bodies are length-prefixed (and possibly base64 encoded) frames that Coraza cannot make sense of,
+	// so we let them follow their regular flow to avoid any risk of corrupting the framing.
+	if tx.IsRequestBodyAccessible() && !isGRPCWeb(req) {
 		// We only do body buffering if the transaction requires request
 		// body inspection, otherwise we just let the request follow its
 		// regular flow.
 		if req.Body != nil && req.Body != http.NoBody {
-			it, _, err := tx.ReadRequestBodyFrom(req.Body)
-			if err != nil {
-				return nil, fmt.Errorf("failed to append request body: %s", err.Error())
+			// src is the reader fed to Coraza, and body the reader served to the handler once src has been
+			// consumed up to the Coraza limit.
+			// The body is read through the request context, so a client disconnecting mid-upload aborts the
+			// inspection instead of wasting work on a body that will never complete.
+			if cr == nil {
+				cr = &contextReader{}
+			}
+			cr.ctx, cr.r, cr.eof = req.Context(), req.Body, false
+			var (
+				src  io.Reader = cr
+				body io.Reader
+				full []byte
+			)
+			// A body buffered in memory is served to the handler with a fresh reader over it, which makes it replayable.
+			if limit, strict := cfg.bodyBufferLimit(); limit > 0 {
+				var err error
+				if full, err = io.ReadAll(io.LimitReader(src, limit+1)); isBodyTooLarge(err) {
+					return &types.Interruption{Action: "deny", Status: http.StatusRequestEntityTooLarge}, types.PhaseRequestBody, nil
+				} else if err != nil {
+					return nil, types.PhaseUnknown, fmt.Errorf("failed to buffer request body: %w", err)
+				}
+				switch {
+				case int64(len(full)) <= limit:
+					src = bytes.NewReader(full)
+				case strict:
+					return &types.Interruption{Action: "deny", Status: http.StatusRequestEntityTooLarge}, types.PhaseRequestBody, nil
+				default:
+					// The body is too large to be replayed, so it streams as usual, starting with the bytes read so far.
+					src, full = io.MultiReader(bytes.NewReader(full), src), nil
+				}
+			}
+			if boundary, ok := multipartBoundary(req); ok && cfg.multipartPartLimit > 0 {
+				// The raw body must be kept for the handler, so buffering stops once as many bytes as can be
+				// inspected have been read, and the remaining parts stream to the handler uninspected.
+				max := bodyLimit(tx, "RequestBodyLimit")
+				if cfg.maxBodySize > 0 && (max == 0 || cfg.maxBodySize < max) {
+					max = cfg.maxBodySize
+				}
+				inspected, raw, err := limitMultipartParts(src, boundary, cfg.multipartPartLimit, max)
+				// The inspected body differs from the original one, so the handler is served with the raw body.
+				body = io.MultiReader(raw, src)
+				if err != nil {
+					// This is not a well-formed multipart body, so we inspect it as is.
+					src, body = body, nil
+				} else {
+					src = inspected
+				}
 			}
 
-			if it != nil {
-				return it, nil
+			// Deeply nested JSON bodies are rejected before reaching the Coraza JSON processor.
+			if cfg.maxJSONDepth > 0 && isJSON(req) {
+				src = &jsonDepthReader{r: src, max: cfg.maxJSONDepth}
 			}
 
-			rbr, err := tx.RequestBodyReader()
+			// The body is consumed as a stream and bytes are counted as they are read, so the body limit applies
+			// the same way to chunked requests, which don't carry a Content-Length. Never rely on req.ContentLength.
+			// Feeding the body in smaller chunks would not interrupt earlier: Coraza only evaluates request body
+			// rules once, in ProcessRequestBody, and writing the body only interrupts when the limit is reached
+			// with SecRequestBodyLimitAction Reject. Reading stops at the limit in any case, which bounds the work
+			// done on large uploads.
+			it, n, err := tx.ReadRequestBodyFrom(src)
+			if errors.Is(err, errJSONTooDeep) {
+				return &types.Interruption{Action: "deny", Status: http.StatusBadRequest}, types.PhaseRequestBody, nil
+			}
+			if isBodyTooLarge(err) {
+				return &types.Interruption{Action: "deny", Status: http.StatusRequestEntityTooLarge}, types.PhaseRequestBody, nil
+			}
 			if err != nil {
-				return nil, fmt.Errorf("failed to get the request body: %s", err.Error())
+				return nil, types.PhaseUnknown, fmt.Errorf("failed to append request body: %w", err)
+			}
+			// Like Coraza with SecRequestBodyLimitAction Reject, a body reaching the limit is rejected.
+			if it == nil && rejectOverLimit {
+				if limit := bodyLimit(tx, "RequestBodyLimit"); limit > 0 && int64(n) >= limit {
+					it = &types.Interruption{Action: "deny", Status: http.StatusRequestEntityTooLarge}
+				}
+			}
+
+			tail := src
+			if cfg.recorder != nil {
+				cfg.recorder.ObserveRequestBodyBytes(n, true)
+				tail = passThroughReader{src, cfg.recorder}
+			}
+
+			// remainder reads the bytes beyond those inspected, it is nil if the inspected bytes are not a prefix of the
+			// body, e.g. with a multipart part limit.
+			var remainder io.Reader
+			if full != nil {
+				// The whole body is already in memory, so the handler is served with a fresh reader over it.
+				if cfg.recorder != nil && len(full) > int(n) {
+					cfg.recorder.ObserveRequestBodyBytes(len(full)-int(n), false)
+				}
+				body = &bufferedBody{Reader: bytes.NewReader(full), buf: full}
+			} else if body == nil {
+				rbr, err := tx.RequestBodyReader()
+				if err != nil {
+					return nil, types.PhaseUnknown, fmt.Errorf("failed to get the request body: %w", err)
+				}
+
+				// Adds all remaining bytes beyond the coraza limit to its buffer
+				// It happens when the partial body has been processed and it did not trigger an interruption
+				// A body entirely consumed doesn't need it, which saves an allocation in the common case. The end of the
+				// body is detected as it is read, whether or not it carries a Content-Length.
+				if cr.eof {
+					body, remainder = rbr, http.NoBody
+				} else {
+					body, remainder = io.MultiReader(rbr, tail), tail
+				}
 			}
 
-			// Adds all remaining bytes beyond the coraza limit to its buffer
-			// It happens when the partial body has been processed and it did not trigger an interruption
-			body := io.MultiReader(rbr, req.Body)
 			// req.Body is transparently reinizialied with a new io.ReadCloser.
 			// The http handler will be able to read it.
 			// Prior to Go 1.19 NopCloser does not implement WriterTo if the reader implements it.
@@ -181,21 +699,237 @@ func processRequest(tx types.Transaction, req *http.Request) (*types.Interruptio
 			// using io.Copy.
 			// In Go 1.19 we just do `req.Body = io.NopCloser(reader)`
 			if rwt, ok := body.(io.WriterTo); ok {
-				req.Body = struct {
-					io.Reader
-					io.WriterTo
-					io.Closer
-				}{body, rwt, req.Body}
+				req.Body = reassembledBodyWriterTo{body, rwt, req.Body, remainder}
 			} else {
-				req.Body = struct {
-					io.Reader
-					io.Closer
-				}{body, req.Body}
+				req.Body = reassembledBody{body, req.Body, remainder}
+			}
+
+			// The body is reassembled even if the request is interrupted, so it can still be read by the handler
+			// if the interruption is demoted.
+			if it != nil {
+				return it, types.PhaseRequestBody, nil
+			}
+		}
+	} else if cfg.recorder != nil && req.Body != nil && req.Body != http.NoBody {
+		// The body is not inspected, we only account for the bytes read by the handler.
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{passThroughReader{req.Body, cfg.recorder}, req.Body}
+	}
+
+	in, err := tx.ProcessRequestBody()
+	if err != nil {
+		return nil, types.PhaseUnknown, err
+	}
+	if in != nil {
+		return in, types.PhaseRequestBody, nil
+	}
+
+	return nil, types.PhaseUnknown, nil
+}
+
+// clientAddr returns the client address and port fed to Coraza, as resolved by the client IP resolver if any, or
+// parsed from the request remote address otherwise.
+func (w *WAF) clientAddr(req *http.Request) (string, int) {
+	if w.cfg.clientIPResolver != nil {
+		return w.cfg.clientIPResolver(req)
+	}
+	return remoteAddr(req)
+}
+
+// remoteAddr parses the client address and port from the request remote address.
+func remoteAddr(req *http.Request) (client string, cport int) {
+	// IMPORTANT: Some http.Request.RemoteAddr implementations will not contain port or contain IPV6: [2001:db8::1]:8080
+	host, port, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		// The address has no port, or is not an IP address at all (e.g. a unix socket), in which case the client
+		// is unknown.
+		host = strings.TrimSuffix(strings.TrimPrefix(req.RemoteAddr, "["), "]")
+		if _, err := netip.ParseAddr(host); err != nil {
+			return "", 0
+		}
+		return host, 0
+	}
+	cport, _ = strconv.Atoi(port)
+	return host, cport
+}
+
+// localAddr returns the server address and port of the connection the request was received on, if available.
+func localAddr(req *http.Request) (server string, sport int) {
+	addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return "", 0
+	}
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP.String(), tcp.Port
+	}
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return "", 0
+	}
+	sport, _ = strconv.Atoi(port)
+	return host, sport
+}
+
+// serverName returns the server name derived from the host, without its port if stripPort is true.
+func serverName(host string, stripPort bool) string {
+	if !stripPort {
+		return host
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// isGRPCWeb reports whether the request carries a gRPC-Web payload (application/grpc-web, application/grpc-web+proto,
+// application/grpc-web-text, ...).
+func isGRPCWeb(req *http.Request) bool {
+	return strings.HasPrefix(strings.ToLower(req.Header.Get("Content-Type")), "application/grpc-web")
+}
+
+// reassembledBody is the request body rebuilt from the bytes buffered by Coraza and the remaining unread bytes of
+// the original body.
+type reassembledBody struct {
+	io.Reader
+	io.Closer
+	// remainder reads the bytes of the body which were not inspected, if the inspected bytes are a prefix of the body.
+	remainder io.Reader
+}
+
+// isBodyTooLarge reports whether err is caused by a request body exceeding WithMaxRequestBodySize.
+func isBodyTooLarge(err error) bool {
+	var mbe *http.MaxBytesError
+	return errors.As(err, &mbe)
+}
+
+// contextReader is a reader failing with the context error once the context is done. It records whether the end of
+// the underlying reader has been reached, so we know when a body has been entirely consumed, even without a
+// Content-Length.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+	eof bool
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := r.r.Read(p)
+	if err == io.EOF {
+		r.eof = true
+	}
+	return n, err
+}
+
+// putContextReader returns the reader to the pool, without retaining the request context nor the body.
+func putContextReader(r *contextReader) {
+	*r = contextReader{}
+	contextReaderPool.Put(r)
+}
+
+// bufferedBody is the request body fully buffered in memory by WithFullRequestBuffering or WithReplayableBody.
+type bufferedBody struct {
+	*bytes.Reader
+	buf []byte
+}
+
+// reassembledBodyWriterTo is a reassembledBody whose reader implements io.WriterTo.
+type reassembledBodyWriterTo struct {
+	io.Reader
+	io.WriterTo
+	io.Closer
+	remainder io.Reader
+}
+
+// headerBlockSize estimates the size of the request header block as it was sent on the wire, each field being
+// counted as "Key: Value\r\n". The Host header, which is promoted to the request by net/http, is included.
+func headerBlockSize(req *http.Request) int {
+	size := 0
+	if req.Host != "" {
+		size += len("Host: \r\n") + len(req.Host)
+	}
+	for k, vv := range req.Header {
+		if k == "Host" {
+			continue
+		}
+		for _, v := range vv {
+			size += len(k) + len(": \r\n") + len(v)
+		}
+	}
+	return size
+}
+
+// hasBody reports whether the request carries a body.
+func hasBody(req *http.Request) bool {
+	return req.Body != nil && req.Body != http.NoBody && req.ContentLength != 0
+}
+
+// addRequestHeader adds the values of a request header to the transaction. It reports false if a value exceeds the
+// maximum header value size and can't be truncated.
+func addRequestHeader(tx types.Transaction, k string, vv []string, cfg *config) bool {
+	// HTTP/2 requests may carry a Host header along with the :authority pseudo-header, which takes precedence and is
+	// promoted to the Request.Host field. Only the latter is fed to the transaction, as with HTTP/1.
+	if k == "Host" {
+		return true
+	}
+	for _, v := range vv {
+		if cfg.maxHeaderValueSize > 0 && len(v) > cfg.maxHeaderValueSize {
+			if !cfg.truncateHeaderValues {
+				return false
+			}
+			v = v[:cfg.maxHeaderValueSize]
+		}
+		// The header is still visible to the rules, but its value is not recorded by the transaction.
+		if slices.Contains(cfg.redactedHeaders, k) {
+			v = redactedValue
+		}
+		tx.AddRequestHeader(k, v)
+	}
+	return true
+}
+
+// cookieStats returns the number of cookies and the total size of the Cookie headers of the request.
+func cookieStats(req *http.Request) (count, size int) {
+	for _, v := range req.Header.Values("Cookie") {
+		size += len(v)
+		for _, c := range strings.Split(v, ";") {
+			if strings.TrimSpace(c) != "" {
+				count++
 			}
 		}
 	}
+	return count, size
+}
+
+// hasAmbiguousBodyFraming reports whether the request declares both a Transfer-Encoding and a Content-Length.
+func hasAmbiguousBodyFraming(req *http.Request) bool {
+	if len(req.TransferEncoding) == 0 {
+		return false
+	}
+	return req.ContentLength > 0 || req.Header.Get("Content-Length") != ""
+}
 
-	return tx.ProcessRequestBody()
+// chunkedEncodingErrors are the messages of the errors returned by the net/http chunked reader when decoding a
+// malformed chunked body. These errors are not exported, so we have to rely on their message.
+var chunkedEncodingErrors = []string{
+	"malformed chunked encoding",
+	"invalid byte in chunk length",
+	"http chunk length too large",
+	"chunked encoding contains too much non-data",
+}
+
+// isMalformedChunkedEncoding reports whether err is caused by a malformed chunked request body.
+func isMalformedChunkedEncoding(err error) bool {
+	msg := err.Error()
+	for _, s := range chunkedEncodingErrors {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
 }
 
 // processResponse takes care of the response body copyback from the transaction buffer.
@@ -203,53 +937,185 @@ func processResponse(tx types.Transaction, i *rwInterceptor) error {
 	// We look for interruptions triggered at phase 3 (response headers)
 	// and during writing the response body. If so, response status code
 	// has been sent over the flush already.
-	if tx.IsInterrupted() {
+	if i.interrupted() {
 		return nil
 	}
 
-	if tx.IsResponseBodyAccessible() && tx.IsResponseBodyProcessable() {
+	// The handler set the status code without writing any body, which leaves nothing to sniff.
+	if i.headerPending {
+		i.resolveHeader()
+		if i.interrupted() {
+			return nil
+		}
+	}
+
+	if i.bufferBody {
+		var rewritten []byte
+		if i.cfg.responseRewriter != nil {
+			rewritten = i.rewrite()
+			if it, _, err := tx.WriteResponseBody(rewritten); err != nil {
+				i.writeError()
+				return fmt.Errorf("failed to write the rewritten response body: %w", err)
+			} else if isBlocking(tx, it, i.cfg) {
+				i.interrupt(it, types.PhaseResponseBody)
+				return nil
+			}
+		}
+
 		if it, err := tx.ProcessResponseBody(); err != nil {
-			i.overrideWriteHeader(http.StatusInternalServerError)
-			i.flushWriteHeader()
+			i.writeError()
 			return err
-		} else if it != nil {
+		} else if isBlocking(tx, it, i.cfg) {
 			// if there is an interruption we must clean the headers and override the status code
-			i.cleanHeaders()
-			i.Header().Set("Content-Length", "0")
-			i.overrideWriteHeader(obtainStatusCodeFromInterruptionOrDefault(it, i.statusCode))
-			i.flushWriteHeader()
+			i.interrupt(it, types.PhaseResponseBody)
 			return nil
 		}
 
 		// we release the buffer
-		reader, err := tx.ResponseBodyReader()
-		if err != nil {
-			i.overrideWriteHeader(http.StatusInternalServerError)
-			i.flushWriteHeader()
-			return fmt.Errorf("failed to release the response body reader: %v", err)
+		var (
+			reader io.Reader = bytes.NewReader(rewritten)
+			err    error
+		)
+		if i.cfg.responseRewriter == nil {
+			if reader, err = tx.ResponseBodyReader(); err != nil {
+				i.writeError()
+				return fmt.Errorf("failed to release the response body reader: %v", err)
+			}
+		}
+
+		// The inspection passed and the whole body is buffered, so we know its size and can compress it.
+		if i.shouldCompress() {
+			if reader, err = i.compress(reader); err != nil {
+				i.writeError()
+				return fmt.Errorf("failed to compress the response body: %w", err)
+			}
 		}
 
 		// this is the last opportunity we have to report the resolved status code
 		// as next step is write into the response writer (triggering a 200 in the
 		// response status code.)
 		i.flushWriteHeader()
-		if _, err := io.Copy(i.w, reader); err != nil {
+		if err := i.writeBody(reader); err != nil {
+			return fmt.Errorf("failed to copy the response body: %v", err)
+		}
+	} else if i.holdBody {
+		// The body is not inspected, but response body rules may still block the held response.
+		if it, err := tx.ProcessResponseBody(); err != nil {
+			i.writeError()
+			return err
+		} else if isBlocking(tx, it, i.cfg) {
+			i.interrupt(it, types.PhaseResponseBody)
+			return nil
+		}
+
+		i.flushWriteHeader()
+		if err := i.writeBody(&i.held); err != nil {
 			return fmt.Errorf("failed to copy the response body: %v", err)
 		}
 	} else {
 		i.flushWriteHeader()
+		// The body has been streamed to the client, but the response body rules must still run to report the
+		// final verdict. An interruption can no longer be enforced, so it is only reported as detected.
+		if i.cfg.verdictTrailer {
+			it, err := tx.ProcessResponseBody()
+			if err != nil {
+				return err
+			}
+			i.detected = isBlocking(tx, it, i.cfg)
+		}
 	}
 
 	return nil
 }
 
+// isBlocking reports whether the interruption blocks the transaction. Interruptions caused by a non-blocking rule
+// are logged and demoted.
+func isBlocking(tx types.Transaction, it *types.Interruption, cfg *config) bool {
+	if it == nil {
+		return false
+	}
+	if slices.Contains(cfg.nonBlockingRules, it.RuleID) {
+		tx.DebugLogger().Info().
+			Int("rule_id", it.RuleID).
+			Str("action", it.Action).
+			Msg("Interruption demoted by a non-blocking rule")
+		return false
+	}
+	return true
+}
+
+// setTXVariable sets a variable in the TX collection of the transaction. It reports false if the transaction does not
+// expose its variables.
+func setTXVariable(tx types.Transaction, key, value string) bool {
+	state, ok := tx.(plugintypes.TransactionState)
+	if !ok {
+		return false
+	}
+	state.Variables().TX().Set(key, []string{value})
+	return true
+}
+
+// requestArgs returns the ARGS collection (query and body arguments) parsed by Coraza, or nil if the transaction does
+// not expose its variables.
+func requestArgs(tx types.Transaction) map[string][]string {
+	state, ok := tx.(plugintypes.TransactionState)
+	if !ok {
+		return nil
+	}
+	args := make(map[string][]string)
+	for _, md := range state.Variables().Args().FindAll() {
+		args[md.Key()] = append(args[md.Key()], md.Value())
+	}
+	return args
+}
+
+// setGeoVariables sets the GEO:COUNTRY_CODE and GEO:ASN variables of the transaction, ignoring empty values. It
+// reports false if the transaction does not expose its variables.
+func setGeoVariables(tx types.Transaction, country, asn string) bool {
+	state, ok := tx.(plugintypes.TransactionState)
+	if !ok {
+		return false
+	}
+	if country != "" {
+		state.Variables().Geo().Set("country_code", []string{country})
+	}
+	if asn != "" {
+		state.Variables().Geo().Set("asn", []string{asn})
+	}
+	return true
+}
+
+// statuslessRules returns the ids of the rules denying without status, or nil if the rules can't be found.
+func statuslessRules(waf coraza.WAF) map[int]struct{} {
+	rules, ok := disruptiveRules(waf)
+	if !ok {
+		return nil
+	}
+	ids := make(map[int]struct{})
+	for _, rule := range rules {
+		if rule.action == "deny" && rule.status == 0 {
+			ids[rule.id] = struct{}{}
+		}
+	}
+	return ids
+}
+
 // obtainStatusCodeFromInterruptionOrDefault returns the desired status code derived from the interruption
 // on a "deny" action or a default value.
-func obtainStatusCodeFromInterruptionOrDefault(it *types.Interruption, defaultStatusCode int) int {
-	if it.Action == "deny" {
+func obtainStatusCodeFromInterruptionOrDefault(it *types.Interruption, cfg *config, defaultStatusCode int) int {
+	switch it.Action {
+	case "deny":
+		statusCode := it.Status
+		// Coraza sends a 403 Forbidden when the rule has no status, which gives way to the default deny status.
+		if _, statusless := cfg.statuslessRules[it.RuleID]; statusCode == 0 || statusless {
+			statusCode = cfg.denyStatus
+		}
+
+		return statusCode
+	case "redirect":
 		statusCode := it.Status
-		if statusCode == 0 {
-			statusCode = 403
+		if statusCode < 300 || statusCode > 399 {
+			statusCode = http.StatusFound
 		}
 
 		return statusCode
@@ -257,6 +1123,17 @@ func obtainStatusCodeFromInterruptionOrDefault(it *types.Interruption, defaultSt
 	return defaultStatusCode
 }
 
+// writeRedirectHeaders sets the Location header from a "redirect" interruption, along with an empty body. It reports
+// false if the interruption is not a redirect.
+func writeRedirectHeaders(h http.Header, it *types.Interruption) bool {
+	if it.Action != "redirect" {
+		return false
+	}
+	h.Set("Location", it.Data)
+	h.Set("Content-Length", "0")
+	return true
+}
+
 func relevantCaller() runtime.Frame {
 	pc := make([]uintptr, 16)
 	n := runtime.Callers(1, pc)
@@ -273,3 +1150,60 @@ func relevantCaller() runtime.Frame {
 	}
 	return frame
 }
+
+// ruleRemover is implemented by Coraza transactions, but not exposed by the types.Transaction interface.
+type ruleRemover interface {
+	RemoveRuleByID(id int)
+}
+
+// removeRules removes the rules matching the given ids or tags from the transaction. The tags are resolved with
+// ruleTags, the ids of the rules indexed by tag.
+func removeRules(tx types.Transaction, ids []int, tags []string, ruleTags map[string][]int) {
+	if len(ids) == 0 && len(tags) == 0 {
+		return
+	}
+	rr, ok := tx.(ruleRemover)
+	if !ok {
+		tx.DebugLogger().Warn().Msg("Transaction does not support rule removal, exclusions are ignored")
+		return
+	}
+	for _, id := range ids {
+		rr.RemoveRuleByID(id)
+	}
+	if len(tags) > 0 && ruleTags == nil {
+		tx.DebugLogger().Warn().Msg("Rule tags can't be resolved, tag exclusions are ignored")
+		return
+	}
+	for _, tag := range tags {
+		for _, id := range ruleTags[tag] {
+			rr.RemoveRuleByID(id)
+		}
+	}
+}
+
+// bodyLimit returns the value of the given body limit field of the transaction (RequestBodyLimit or
+// ResponseBodyLimit), including any ctl override, or 0 if unknown. Coraza does not expose the limits, but its
+// transactions carry them as exported fields.
+func bodyLimit(tx types.Transaction, field string) int64 {
+	v := reflect.ValueOf(tx)
+	if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+		return 0
+	}
+	if f := v.Elem().FieldByName(field); f.IsValid() && f.CanInt() {
+		return f.Int()
+	}
+	return 0
+}
+
+// lowerBodyLimit lowers the given body limit field of the transaction (RequestBodyLimit or ResponseBodyLimit) to
+// limit, as the ctl action would. Coraza sizes its body buffers after the WAF limits, so a limit can't be raised, and
+// a non-positive or larger limit is ignored.
+func lowerBodyLimit(tx types.Transaction, field string, limit int64) {
+	v := reflect.ValueOf(tx)
+	if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+		return
+	}
+	if f := v.Elem().FieldByName(field); f.IsValid() && f.CanSet() && f.CanInt() && limit > 0 && limit < f.Int() {
+		f.SetInt(limit)
+	}
+}
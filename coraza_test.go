@@ -0,0 +1,2522 @@
+// Copyright 2024 Sylvain Müller.
+// SPDX-License-Identifier: Apache-2.0
+
+package foxwaf
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/corazawaf/coraza/v3"
+	"github.com/corazawaf/coraza/v3/types"
+	"github.com/tigerwill90/fox"
+	"io"
+	"maps"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// newTestWAF creates a Coraza WAF from the given directives, failing the test if they don't compile.
+func newTestWAF(t testing.TB, directives string) coraza.WAF {
+	t.Helper()
+	waf, err := coraza.NewWAF(coraza.NewWAFConfig().WithDirectives(directives))
+	if err != nil {
+		t.Fatalf("failed to create the WAF: %v", err)
+	}
+	return waf
+}
+
+// serve routes req through a Fox router applying the given middlewares in order before h, and returns the recorded
+// response.
+func serve(req *http.Request, h fox.HandlerFunc, mws ...fox.MiddlewareFunc) *httptest.ResponseRecorder {
+	f := fox.New(fox.WithMiddleware(mws...))
+	f.MustHandle(req.Method, req.URL.Path, h)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	return w
+}
+
+// ok is a handler replying with a 200 OK.
+func ok(c fox.Context) {
+	c.Writer().WriteHeader(http.StatusOK)
+}
+
+func TestIntercept_ChainedMiddlewares(t *testing.T) {
+	var cleans int
+	onClean := WithOnClean(func(c fox.Context) {
+		cleans++
+	})
+	permissive := NewWAF(newTestWAF(t, "SecRuleEngine On"), onClean)
+	strict := NewWAF(newTestWAF(t, `
+		SecRuleEngine On
+		SecRule REQUEST_URI "@contains attack" "id:1,phase:1,deny,status:403"
+	`), onClean)
+
+	cases := []struct {
+		name       string
+		outer      *WAF
+		inner      *WAF
+		wantStatus int
+		wantCleans int
+	}{
+		{
+			name:       "inner instance skips a request cleared upstream",
+			outer:      permissive,
+			inner:      strict,
+			wantStatus: http.StatusOK,
+			wantCleans: 1,
+		},
+		{
+			name:       "same instance applied twice inspects once",
+			outer:      permissive,
+			inner:      permissive,
+			wantStatus: http.StatusOK,
+			wantCleans: 1,
+		},
+		{
+			name:       "outer instance still blocks",
+			outer:      strict,
+			inner:      permissive,
+			wantStatus: http.StatusForbidden,
+			wantCleans: 0,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cleans = 0
+			req := httptest.NewRequest(http.MethodGet, "/attack", nil)
+			w := serve(req, ok, tc.outer.Intercept, tc.inner.Intercept)
+			if w.Code != tc.wantStatus {
+				t.Errorf("status: got %d, want %d", w.Code, tc.wantStatus)
+			}
+			if cleans != tc.wantCleans {
+				t.Errorf("inspections: got %d, want %d", cleans, tc.wantCleans)
+			}
+		})
+	}
+}
+
+func TestWithRejectAmbiguousBodyFraming(t *testing.T) {
+	waf := newTestWAF(t, "SecRuleEngine On\nSecRequestBodyAccess On")
+
+	cases := []struct {
+		name             string
+		enable           bool
+		contentLength    int64
+		transferEncoding []string
+		wantStatus       int
+	}{
+		{
+			name:             "content-length and transfer-encoding are rejected",
+			enable:           true,
+			contentLength:    5,
+			transferEncoding: []string{"chunked"},
+			wantStatus:       http.StatusBadRequest,
+		},
+		{
+			name:          "content-length only is allowed",
+			enable:        true,
+			contentLength: 5,
+			wantStatus:    http.StatusOK,
+		},
+		{
+			name:             "transfer-encoding only is allowed",
+			enable:           true,
+			contentLength:    -1,
+			transferEncoding: []string{"chunked"},
+			wantStatus:       http.StatusOK,
+		},
+		{
+			name:             "ambiguous framing is allowed when disabled",
+			contentLength:    5,
+			transferEncoding: []string{"chunked"},
+			wantStatus:       http.StatusOK,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("hello"))
+			req.ContentLength = tc.contentLength
+			req.TransferEncoding = tc.transferEncoding
+			w := serve(req, ok, Middleware(waf, WithRejectAmbiguousBodyFraming(tc.enable)))
+			if w.Code != tc.wantStatus {
+				t.Errorf("status: got %d, want %d", w.Code, tc.wantStatus)
+			}
+		})
+	}
+}
+
+func TestFullBodyReader(t *testing.T) {
+	const directives = `
+		SecRuleEngine On
+		SecRequestBodyAccess On
+		SecRequestBodyLimit 5
+		SecRequestBodyLimitAction ProcessPartial
+	`
+
+	cases := []struct {
+		name          string
+		directives    string
+		opts          []Option
+		body          string
+		wantInspected string
+		wantOK        bool
+	}{
+		{
+			name:          "body under the limit",
+			directives:    directives,
+			body:          "hey",
+			wantInspected: "hey",
+			wantOK:        true,
+		},
+		{
+			name:          "body over the limit",
+			directives:    directives,
+			body:          "hello world",
+			wantInspected: "hello",
+			wantOK:        true,
+		},
+		{
+			name:          "body fully buffered",
+			directives:    directives,
+			opts:          []Option{WithFullRequestBuffering(64)},
+			body:          "hello world",
+			wantInspected: "hello",
+			wantOK:        true,
+		},
+		{
+			name:       "body not inspected",
+			directives: "SecRuleEngine On\nSecRequestBodyAccess Off",
+			body:       "hello world",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				inspected []byte
+				full      []byte
+				found     bool
+			)
+			h := func(c fox.Context) {
+				inspected, _ = InspectedRequestBody(c)
+				var r io.Reader
+				if r, found = FullBodyReader(c); found {
+					full, _ = io.ReadAll(r)
+				}
+			}
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tc.body))
+			serve(req, h, Middleware(newTestWAF(t, tc.directives), tc.opts...))
+			if found != tc.wantOK {
+				t.Fatalf("found: got %t, want %t", found, tc.wantOK)
+			}
+			if !found {
+				return
+			}
+			if string(inspected) != tc.wantInspected {
+				t.Errorf("inspected: got %q, want %q", inspected, tc.wantInspected)
+			}
+			if string(full) != tc.body {
+				t.Errorf("body: got %q, want %q", full, tc.body)
+			}
+		})
+	}
+}
+
+func TestChunkedRequestBody(t *testing.T) {
+	const rules = `
+		SecAction "id:1,phase:1,pass,nolog,ctl:forceRequestBodyVariable=On"
+		SecRule REQUEST_BODY "@contains world" "id:2,phase:2,deny,status:403"
+	`
+	reject := newTestWAF(t, `
+		SecRuleEngine On
+		SecRequestBodyAccess On
+		SecRequestBodyLimit 5
+		SecRequestBodyLimitAction Reject
+		`+rules)
+	partial := newTestWAF(t, `
+		SecRuleEngine On
+		SecRequestBodyAccess On
+		SecRequestBodyLimit 5
+		SecRequestBodyLimitAction ProcessPartial
+		`+rules)
+
+	cases := []struct {
+		name       string
+		waf        coraza.WAF
+		body       string
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "reject under the limit",
+			waf:        reject,
+			body:       "hey",
+			wantStatus: http.StatusOK,
+			wantBody:   "hey",
+		},
+		{
+			name:       "reject at the limit",
+			waf:        reject,
+			body:       "hello",
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:       "reject over the limit",
+			waf:        reject,
+			body:       "hello world",
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:       "partial under the limit is inspected",
+			waf:        partial,
+			body:       "world",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "partial at the limit",
+			waf:        partial,
+			body:       "hello",
+			wantStatus: http.StatusOK,
+			wantBody:   "hello",
+		},
+		{
+			name:       "partial over the limit truncates the inspection",
+			waf:        partial,
+			body:       "hello world",
+			wantStatus: http.StatusOK,
+			wantBody:   "hello world",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []byte
+			h := func(c fox.Context) {
+				got, _ = io.ReadAll(c.Request().Body)
+				c.Writer().WriteHeader(http.StatusOK)
+			}
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tc.body))
+			req.ContentLength = -1
+			req.TransferEncoding = []string{"chunked"}
+			w := serve(req, h, Middleware(tc.waf))
+			if w.Code != tc.wantStatus {
+				t.Errorf("status: got %d, want %d", w.Code, tc.wantStatus)
+			}
+			if string(got) != tc.wantBody {
+				t.Errorf("body: got %q, want %q", got, tc.wantBody)
+			}
+		})
+	}
+}
+
+// multipartBody encodes the given fields, in order, as a multipart body and returns it along with its content type.
+func multipartBody(t testing.TB, fields ...[2]string) (string, string) {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for _, field := range fields {
+		if err := mw.WriteField(field[0], field[1]); err != nil {
+			t.Fatalf("failed to write field: %v", err)
+		}
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatalf("failed to close multipart writer: %v", err)
+	}
+	return buf.String(), mw.FormDataContentType()
+}
+
+func TestWithMultipartPartLimit(t *testing.T) {
+	const directives = `
+		SecRuleEngine On
+		SecRequestBodyAccess On
+		SecRequestBodyLimit %d
+		SecRequestBodyLimitAction ProcessPartial
+		SecRule ARGS "@contains attack" "id:1,phase:2,deny,status:403"
+	`
+
+	cases := []struct {
+		name       string
+		bodyLimit  int
+		opts       []Option
+		fields     [][2]string
+		wantStatus int
+	}{
+		{
+			name:       "bytes past the part limit are not inspected",
+			bodyLimit:  1024,
+			fields:     [][2]string{{"a", strings.Repeat("x", 10) + "attack"}},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "parts following a truncated part are inspected",
+			bodyLimit:  1024,
+			fields:     [][2]string{{"a", strings.Repeat("x", 10)}, {"b", "attack"}},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "parts past the body limit stream uninspected",
+			bodyLimit:  512,
+			fields:     [][2]string{{"a", strings.Repeat("x", 1024)}, {"b", "attack"}},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "bodies past the max body size are rejected",
+			bodyLimit:  1024,
+			opts:       []Option{WithMaxRequestBodySize(256)},
+			fields:     [][2]string{{"a", strings.Repeat("x", 512)}, {"b", "attack"}},
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			waf := newTestWAF(t, fmt.Sprintf(directives, tc.bodyLimit))
+			body, contentType := multipartBody(t, tc.fields...)
+			var got []byte
+			h := func(c fox.Context) {
+				got, _ = io.ReadAll(c.Request().Body)
+				c.Writer().WriteHeader(http.StatusOK)
+			}
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+			req.Header.Set("Content-Type", contentType)
+			w := serve(req, h, Middleware(waf, append(tc.opts, WithMultipartPartLimit(8))...))
+			if w.Code != tc.wantStatus {
+				t.Errorf("status: got %d, want %d", w.Code, tc.wantStatus)
+			}
+			if w.Code == http.StatusOK && string(got) != body {
+				t.Errorf("body: got %q, want %q", got, body)
+			}
+		})
+	}
+}
+
+func TestStdMiddleware(t *testing.T) {
+	waf := newTestWAF(t, `
+		SecRuleEngine On
+		SecRule ARGS:id "@eq 0" "id:1,phase:1,deny,status:403"
+	`)
+	h := StdMiddleware(waf)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	cases := []struct {
+		name       string
+		method     string
+		target     string
+		wantStatus int
+	}{
+		{
+			name:       "allowed request",
+			method:     http.MethodGet,
+			target:     "/foo",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "allowed request with a custom method",
+			method:     "PROPFIND",
+			target:     "/foo/",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "blocked request",
+			method:     http.MethodPost,
+			target:     "/foo?id=0",
+			wantStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(tc.method, tc.target, nil))
+			if w.Code != tc.wantStatus {
+				t.Errorf("status: got %d, want %d", w.Code, tc.wantStatus)
+			}
+		})
+	}
+}
+
+func TestWithMaxRequestHeaderBytes(t *testing.T) {
+	waf := newTestWAF(t, "SecRuleEngine On")
+
+	cases := []struct {
+		name       string
+		limit      int
+		value      string
+		wantStatus int
+	}{
+		{
+			name:       "header block under the limit",
+			limit:      256,
+			value:      "short",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "header block over the limit",
+			limit:      256,
+			value:      strings.Repeat("x", 256),
+			wantStatus: http.StatusRequestHeaderFieldsTooLarge,
+		},
+		{
+			name:       "limit disabled",
+			value:      strings.Repeat("x", 256),
+			wantStatus: http.StatusOK,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("X-Value", tc.value)
+			w := serve(req, ok, Middleware(waf, WithMaxRequestHeaderBytes(tc.limit)))
+			if w.Code != tc.wantStatus {
+				t.Errorf("status: got %d, want %d", w.Code, tc.wantStatus)
+			}
+		})
+	}
+}
+
+func TestWithRequestVeto(t *testing.T) {
+	waf := newTestWAF(t, "SecRuleEngine On\nSecRequestBodyAccess On")
+	veto := func(status int) Option {
+		return WithRequestVeto(func(c fox.Context, args map[string][]string) *Verdict {
+			if slices.Contains(args["user"], "mallory") {
+				return &Verdict{Status: status}
+			}
+			return nil
+		})
+	}
+
+	cases := []struct {
+		name       string
+		opts       []Option
+		target     string
+		body       string
+		wantStatus int
+	}{
+		{
+			name:       "request allowed",
+			opts:       []Option{veto(http.StatusUnavailableForLegalReasons)},
+			target:     "/?user=alice",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "request vetoed from query arguments",
+			opts:       []Option{veto(http.StatusUnavailableForLegalReasons)},
+			target:     "/?user=mallory",
+			wantStatus: http.StatusUnavailableForLegalReasons,
+		},
+		{
+			name:       "request vetoed from body arguments",
+			opts:       []Option{veto(http.StatusUnavailableForLegalReasons)},
+			target:     "/",
+			body:       "user=mallory",
+			wantStatus: http.StatusUnavailableForLegalReasons,
+		},
+		{
+			name:       "request vetoed with the default deny status",
+			opts:       []Option{veto(0), WithDefaultDenyStatus(http.StatusNotAcceptable)},
+			target:     "/?user=mallory",
+			wantStatus: http.StatusNotAcceptable,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tc.target, strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := serve(req, ok, Middleware(waf, tc.opts...))
+			if w.Code != tc.wantStatus {
+				t.Errorf("status: got %d, want %d", w.Code, tc.wantStatus)
+			}
+		})
+	}
+}
+
+func TestTransaction(t *testing.T) {
+	cases := []struct {
+		name       string
+		directives string
+		wantDuring bool
+	}{
+		{
+			name:       "transaction available to the handler only",
+			directives: "SecRuleEngine On",
+			wantDuring: true,
+		},
+		{
+			name:       "request not inspected",
+			directives: "SecRuleEngine Off",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				req    *http.Request
+				during bool
+			)
+			h := func(c fox.Context) {
+				var tx types.Transaction
+				tx, during = Transaction(c)
+				if during && tx == nil {
+					t.Error("transaction: got nil, want a transaction")
+				}
+				req = c.Request()
+			}
+			serve(httptest.NewRequest(http.MethodGet, "/", nil), h, Middleware(newTestWAF(t, tc.directives)))
+			if during != tc.wantDuring {
+				t.Errorf("during the request: got %t, want %t", during, tc.wantDuring)
+			}
+			// The transaction is closed once the middleware returns.
+			if tx, after := Transaction(fox.NewTestContextOnly(httptest.NewRecorder(), req)); after || tx != nil {
+				t.Errorf("after the request: got %v, %t, want nil, false", tx, after)
+			}
+		})
+	}
+}
+
+func TestWithAllowedOrigins(t *testing.T) {
+	waf := newTestWAF(t, "SecRuleEngine On")
+
+	cases := []struct {
+		name       string
+		method     string
+		origin     string
+		referer    string
+		status     int
+		wantStatus int
+	}{
+		{
+			name:       "allowed origin",
+			method:     http.MethodPost,
+			origin:     "https://EXAMPLE.com",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "disallowed origin",
+			method:     http.MethodPost,
+			origin:     "https://evil.com",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "disallowed origin with status",
+			method:     http.MethodPost,
+			origin:     "https://evil.com",
+			status:     http.StatusConflict,
+			wantStatus: http.StatusConflict,
+		},
+		{
+			name:       "allowed referer",
+			method:     http.MethodDelete,
+			referer:    "https://example.com/account?id=1",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "disallowed referer",
+			method:     http.MethodPut,
+			referer:    "https://evil.com/account",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "origin takes precedence over referer",
+			method:     http.MethodPatch,
+			origin:     "https://evil.com",
+			referer:    "https://example.com/",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "no origin nor referer",
+			method:     http.MethodPost,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "safe method",
+			method:     http.MethodGet,
+			origin:     "https://evil.com",
+			wantStatus: http.StatusOK,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, "/", nil)
+			if tc.origin != "" {
+				req.Header.Set("Origin", tc.origin)
+			}
+			if tc.referer != "" {
+				req.Header.Set("Referer", tc.referer)
+			}
+			w := serve(req, ok, Middleware(waf, WithAllowedOrigins(tc.status, "https://example.com/")))
+			if w.Code != tc.wantStatus {
+				t.Errorf("status: got %d, want %d", w.Code, tc.wantStatus)
+			}
+		})
+	}
+}
+
+func TestWithReplayableBody(t *testing.T) {
+	cases := []struct {
+		name        string
+		directives  string
+		opts        []Option
+		body        string
+		contentType string
+		wantReset   bool
+	}{
+		{
+			name:       "body under the limit",
+			directives: "SecRuleEngine On\nSecRequestBodyAccess On",
+			opts:       []Option{WithReplayableBody(16)},
+			body:       "hello",
+			wantReset:  true,
+		},
+		{
+			name:       "body over the limit is not rejected",
+			directives: "SecRuleEngine On\nSecRequestBodyAccess On",
+			opts:       []Option{WithReplayableBody(4)},
+			body:       "hello world",
+		},
+		{
+			name:       "full buffering takes precedence",
+			directives: "SecRuleEngine On\nSecRequestBodyAccess On",
+			opts:       []Option{WithReplayableBody(4), WithFullRequestBuffering(16)},
+			body:       "hello world",
+			wantReset:  true,
+		},
+		{
+			name:       "request body access off",
+			directives: "SecRuleEngine On\nSecRequestBodyAccess Off",
+			opts:       []Option{WithReplayableBody(16)},
+			body:       "hello",
+		},
+		{
+			name:        "grpc-web body",
+			directives:  "SecRuleEngine On\nSecRequestBodyAccess On",
+			opts:        []Option{WithReplayableBody(16)},
+			body:        "hello",
+			contentType: "application/grpc-web+proto",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				first, second string
+				reset         bool
+			)
+			h := func(c fox.Context) {
+				b, _ := io.ReadAll(c.Request().Body)
+				first = string(b)
+				if reset = ResetBody(c); reset {
+					b, _ = io.ReadAll(c.Request().Body)
+					second = string(b)
+				}
+				c.Writer().WriteHeader(http.StatusOK)
+			}
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tc.body))
+			if tc.contentType != "" {
+				req.Header.Set("Content-Type", tc.contentType)
+			}
+			w := serve(req, h, Middleware(newTestWAF(t, tc.directives), tc.opts...))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status: got %d, want %d", w.Code, http.StatusOK)
+			}
+			if first != tc.body {
+				t.Errorf("body: got %q, want %q", first, tc.body)
+			}
+			if reset != tc.wantReset {
+				t.Errorf("reset: got %t, want %t", reset, tc.wantReset)
+			}
+			if tc.wantReset && second != tc.body {
+				t.Errorf("replayed body: got %q, want %q", second, tc.body)
+			}
+		})
+	}
+}
+
+func TestWithRateLimit(t *testing.T) {
+	cases := []struct {
+		name       string
+		directives string
+		wantStatus []int
+	}{
+		{
+			name:       "rule engine on",
+			directives: "SecRuleEngine On",
+			wantStatus: []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests},
+		},
+		{
+			name:       "rule engine off",
+			directives: "SecRuleEngine Off",
+			wantStatus: []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			mw := Middleware(newTestWAF(t, tc.directives), WithRateLimit(2, time.Hour))
+			for i, want := range tc.wantStatus {
+				w := serve(httptest.NewRequest(http.MethodGet, "/", nil), ok, mw)
+				if w.Code != want {
+					t.Errorf("request %d status: got %d, want %d", i, w.Code, want)
+				}
+			}
+			// Another client has its own bucket.
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = "192.0.2.2:1234"
+			if w := serve(req, ok, mw); w.Code != http.StatusOK {
+				t.Errorf("other client status: got %d, want %d", w.Code, http.StatusOK)
+			}
+		})
+	}
+}
+
+func TestWithRateLimit_Invalid(t *testing.T) {
+	cases := []struct {
+		name   string
+		perIP  int
+		window time.Duration
+	}{
+		{name: "zero requests", perIP: 0, window: time.Second},
+		{name: "negative requests", perIP: -1, window: time.Second},
+		{name: "zero window", perIP: 1, window: 0},
+		{name: "negative window", perIP: 1, window: -time.Second},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("expected a panic")
+				}
+			}()
+			WithRateLimit(tc.perIP, tc.window)
+		})
+	}
+}
+
+func TestWithMaxJSONDepth(t *testing.T) {
+	waf := newTestWAF(t, "SecRuleEngine On\nSecRequestBodyAccess On")
+
+	cases := []struct {
+		name       string
+		body       string
+		wantStatus int
+	}{
+		{
+			name:       "within the limit",
+			body:       `{"a":[{"b":1}]}`,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "too deep",
+			body:       `{"a":[{"b":[1]}]}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "brackets in strings are ignored",
+			body:       `{"a":"[[[[{{{{\"[[["}`,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "unbalanced closers do not raise the limit",
+			body:       `]]]]{"a":[{"b":[1]}]}`,
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			w := serve(req, ok, Middleware(waf, WithMaxJSONDepth(3)))
+			if w.Code != tc.wantStatus {
+				t.Errorf("status: got %d, want %d", w.Code, tc.wantStatus)
+			}
+		})
+	}
+}
+
+func TestWithMaxRequestBodySize(t *testing.T) {
+	// The handler reports a body exceeding the cap with a 413, and echoes the body length otherwise.
+	h := func(c fox.Context) {
+		b, err := io.ReadAll(c.Request().Body)
+		var mbe *http.MaxBytesError
+		if errors.As(err, &mbe) {
+			c.Writer().WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		_, _ = fmt.Fprint(c.Writer(), len(b))
+	}
+
+	cases := []struct {
+		name          string
+		directives    string
+		body          string
+		unknownLength bool
+		wantStatus    int
+		wantBody      string
+	}{
+		{
+			name:       "body under the cap",
+			directives: "SecRuleEngine On\nSecRequestBodyAccess On",
+			body:       strings.Repeat("a", 16),
+			wantStatus: http.StatusOK,
+			wantBody:   "16",
+		},
+		{
+			name:       "declared length over the cap",
+			directives: "SecRuleEngine On\nSecRequestBodyAccess On",
+			body:       strings.Repeat("a", 32),
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:          "inspected body over the cap",
+			directives:    "SecRuleEngine On\nSecRequestBodyAccess On",
+			body:          strings.Repeat("a", 32),
+			unknownLength: true,
+			wantStatus:    http.StatusRequestEntityTooLarge,
+		},
+		{
+			name: "body over the cap past the inspected bytes",
+			directives: `
+				SecRuleEngine On
+				SecRequestBodyAccess On
+				SecRequestBodyLimit 8
+				SecRequestBodyLimitAction ProcessPartial
+			`,
+			body:          strings.Repeat("a", 32),
+			unknownLength: true,
+			wantStatus:    http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:          "body access off",
+			directives:    "SecRuleEngine On",
+			body:          strings.Repeat("a", 32),
+			unknownLength: true,
+			wantStatus:    http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tc.body))
+			if tc.unknownLength {
+				req.ContentLength = -1
+			}
+			w := serve(req, h, Middleware(newTestWAF(t, tc.directives), WithMaxRequestBodySize(16)))
+			if w.Code != tc.wantStatus {
+				t.Errorf("status: got %d, want %d", w.Code, tc.wantStatus)
+			}
+			if tc.wantBody != "" && w.Body.String() != tc.wantBody {
+				t.Errorf("body: got %q, want %q", w.Body.String(), tc.wantBody)
+			}
+		})
+	}
+}
+
+// recordingTracer is a Tracer recording the events of the spans it starts.
+type recordingTracer struct {
+	events []string
+	ended  int
+}
+
+func (t *recordingTracer) Start(context.Context, string) Span { return t }
+
+func (t *recordingTracer) SetAttribute(string, any) {}
+
+func (t *recordingTracer) AddEvent(name string, _ map[string]any) { t.events = append(t.events, name) }
+
+func (t *recordingTracer) End() { t.ended++ }
+
+func TestWithIPDenylist(t *testing.T) {
+	waf := newTestWAF(t, "SecRuleEngine On")
+
+	cases := []struct {
+		name       string
+		remoteAddr string
+		status     int
+		wantStatus int
+		wantNotify bool
+	}{
+		{
+			name:       "denied client",
+			remoteAddr: "192.0.2.1:1234",
+			status:     http.StatusUnavailableForLegalReasons,
+			wantStatus: http.StatusUnavailableForLegalReasons,
+			wantNotify: true,
+		},
+		{
+			name:       "denied client with the default status",
+			remoteAddr: "192.0.2.1:1234",
+			wantStatus: http.StatusForbidden,
+			wantNotify: true,
+		},
+		{
+			name:       "other client",
+			remoteAddr: "198.51.100.1:1234",
+			wantStatus: http.StatusOK,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				notified  *types.Interruption
+				phase     types.RulePhase
+				fromCtx   Result
+				hasResult bool
+			)
+			tracer := &recordingTracer{}
+			mw := Middleware(waf,
+				WithIPDenylist([]netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}, tc.status),
+				WithTracer(tracer),
+				WithOnInterruption(func(c fox.Context, it *types.Interruption, p types.RulePhase) {
+					notified, phase = it, p
+					fromCtx, hasResult = InterruptionFromContext(c)
+				}),
+			)
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tc.remoteAddr
+			w := serve(req, ok, mw)
+			if w.Code != tc.wantStatus {
+				t.Errorf("status: got %d, want %d", w.Code, tc.wantStatus)
+			}
+			if !tc.wantNotify {
+				if notified != nil {
+					t.Errorf("unexpected interruption: %+v", notified)
+				}
+				return
+			}
+			if notified == nil || notified.Status != tc.wantStatus || phase != types.PhaseRequestHeaders {
+				t.Fatalf("interruption: got %+v at phase %d, want status %d at phase %d", notified, phase, tc.wantStatus, types.PhaseRequestHeaders)
+			}
+			if !hasResult || fromCtx.Interruption != notified || fromCtx.Phase != types.PhaseRequestHeaders {
+				t.Errorf("result: got %+v, %t", fromCtx, hasResult)
+			}
+			if !slices.Equal(tracer.events, []string{"waf.interruption"}) || tracer.ended != 1 {
+				t.Errorf("span: got events %v ended %d times, want one interruption event and ended once", tracer.events, tracer.ended)
+			}
+		})
+	}
+}
+
+func TestWAF_SetIPAllowlist(t *testing.T) {
+	w := NewWAF(newTestWAF(t, `
+		SecRuleEngine On
+		SecRule REQUEST_URI "@contains attack" "id:1,phase:1,deny,status:403"
+	`), WithIPAllowlist([]netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}))
+
+	// The steps share the same WAF, so they run in order.
+	steps := []struct {
+		name       string
+		allowlist  []netip.Prefix
+		update     bool
+		remoteAddr string
+		wantStatus int
+	}{
+		{
+			name:       "allowlisted client bypasses the rules",
+			remoteAddr: "192.0.2.1:1234",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "ipv4-mapped ipv6 client is allowlisted",
+			remoteAddr: "[::ffff:192.0.2.1]:1234",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "other client is inspected",
+			remoteAddr: "198.51.100.1:1234",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "list replaced at runtime",
+			allowlist:  []netip.Prefix{netip.MustParsePrefix("198.51.100.0/24")},
+			update:     true,
+			remoteAddr: "198.51.100.1:1234",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "previously allowlisted client is inspected",
+			remoteAddr: "192.0.2.1:1234",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "empty list disables the allowlist",
+			update:     true,
+			remoteAddr: "198.51.100.1:1234",
+			wantStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, step := range steps {
+		if step.update {
+			w.SetIPAllowlist(step.allowlist)
+		}
+		req := httptest.NewRequest(http.MethodGet, "/attack", nil)
+		req.RemoteAddr = step.remoteAddr
+		rec := serve(req, ok, w.Intercept)
+		if rec.Code != step.wantStatus {
+			t.Errorf("%s: status: got %d, want %d", step.name, rec.Code, step.wantStatus)
+		}
+	}
+}
+
+func TestWithErrorHandler(t *testing.T) {
+	waf := newTestWAF(t, "SecRuleEngine On\nSecRequestBodyAccess On")
+
+	cases := []struct {
+		name       string
+		bodyErr    error
+		handler    func(c fox.Context, err error)
+		wantStatus int
+		wantCalled bool
+	}{
+		{
+			name:       "processing failure",
+			bodyErr:    errors.New("connection reset"),
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name:       "malformed chunked body",
+			bodyErr:    errors.New("malformed chunked encoding"),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:    "error handler writing the response",
+			bodyErr: errors.New("malformed chunked encoding"),
+			handler: func(c fox.Context, err error) {
+				c.Writer().WriteHeader(http.StatusBadGateway)
+			},
+			wantStatus: http.StatusBadGateway,
+			wantCalled: true,
+		},
+		{
+			name:       "error handler only observing the failure",
+			bodyErr:    errors.New("malformed chunked encoding"),
+			handler:    func(c fox.Context, err error) {},
+			wantStatus: http.StatusInternalServerError,
+			wantCalled: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var handlerErr error
+			var opts []Option
+			if tc.handler != nil {
+				opts = append(opts, WithErrorHandler(func(c fox.Context, err error) {
+					handlerErr = err
+					tc.handler(c, err)
+				}))
+			}
+			var nextCalled bool
+			next := func(c fox.Context) {
+				nextCalled = true
+				ok(c)
+			}
+			req := httptest.NewRequest(http.MethodPost, "/", iotest.ErrReader(tc.bodyErr))
+			req.ContentLength = -1
+			w := serve(req, next, Middleware(waf, opts...))
+			if w.Code != tc.wantStatus {
+				t.Errorf("status: got %d, want %d", w.Code, tc.wantStatus)
+			}
+			if nextCalled {
+				t.Error("the next handler must not be called")
+			}
+			if tc.wantCalled && !errors.Is(handlerErr, tc.bodyErr) {
+				t.Errorf("error handler: got %v, want %v", handlerErr, tc.bodyErr)
+			}
+		})
+	}
+}
+
+func TestWithMaxCookies(t *testing.T) {
+	waf := newTestWAF(t, "SecRuleEngine On")
+
+	cases := []struct {
+		name       string
+		count      int
+		totalSize  int
+		status     int
+		cookies    []string
+		wantStatus int
+	}{
+		{
+			name:       "within the limits",
+			count:      2,
+			totalSize:  32,
+			cookies:    []string{"a=1; b=2"},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "too many cookies",
+			count:      2,
+			cookies:    []string{"a=1; b=2", "c=3"},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "too many cookies with status",
+			count:      2,
+			status:     http.StatusRequestHeaderFieldsTooLarge,
+			cookies:    []string{"a=1; b=2", "c=3"},
+			wantStatus: http.StatusRequestHeaderFieldsTooLarge,
+		},
+		{
+			name:       "empty cookies are not counted",
+			count:      2,
+			cookies:    []string{"a=1;; ;b=2;"},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "cookie headers too large",
+			totalSize:  16,
+			cookies:    []string{"a=1", "b=" + strings.Repeat("x", 16)},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "limits disabled",
+			cookies:    []string{"a=1; b=2; c=3", "d=" + strings.Repeat("x", 64)},
+			wantStatus: http.StatusOK,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			for _, v := range tc.cookies {
+				req.Header.Add("Cookie", v)
+			}
+			w := serve(req, ok, Middleware(waf, WithMaxCookies(tc.count, tc.totalSize, tc.status)))
+			if w.Code != tc.wantStatus {
+				t.Errorf("status: got %d, want %d", w.Code, tc.wantStatus)
+			}
+		})
+	}
+}
+
+func TestHTTP2Authority(t *testing.T) {
+	// The request is denied only if a single Host header carrying the authority is seen, along with the server name.
+	waf := newTestWAF(t, `
+		SecRuleEngine On
+		SecRule &REQUEST_HEADERS:Host "@eq 1" "id:1,phase:1,deny,status:406,chain"
+			SecRule REQUEST_HEADERS:Host "@streq example.com:8443" "chain"
+			SecRule SERVER_NAME "@beginsWith example.com" "chain"
+			SecRule REQUEST_PROTOCOL "@streq HTTP/2.0"
+	`)
+
+	cases := []struct {
+		name       string
+		authority  string
+		host       string
+		wantStatus int
+	}{
+		{
+			name:       "authority recorded as host",
+			authority:  "example.com:8443",
+			wantStatus: http.StatusNotAcceptable,
+		},
+		{
+			name:       "authority takes precedence over a host header",
+			authority:  "example.com:8443",
+			host:       "evil.com",
+			wantStatus: http.StatusNotAcceptable,
+		},
+		{
+			name:       "other authority",
+			authority:  "other.com",
+			wantStatus: http.StatusOK,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			// The HTTP/2 server promotes the :authority pseudo-header to the Host field, and leaves any Host header
+			// sent along in the header map.
+			req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/2.0", 2, 0
+			req.Host = tc.authority
+			if tc.host != "" {
+				req.Header.Set("Host", tc.host)
+			}
+			w := serve(req, ok, Middleware(waf))
+			if w.Code != tc.wantStatus {
+				t.Errorf("status: got %d, want %d", w.Code, tc.wantStatus)
+			}
+		})
+	}
+}
+
+func TestTransferEncoding(t *testing.T) {
+	waf := newTestWAF(t, `
+		SecRuleEngine On
+		SecRule REQUEST_HEADERS:Transfer-Encoding "@streq gzip, chunked" "id:1,phase:1,deny,status:403"
+	`)
+
+	cases := []struct {
+		name             string
+		transferEncoding []string
+		wantStatus       int
+	}{
+		{
+			name:             "chunked",
+			transferEncoding: []string{"chunked"},
+			wantStatus:       http.StatusOK,
+		},
+		{
+			name:             "stacked encodings",
+			transferEncoding: []string{"gzip", "chunked"},
+			wantStatus:       http.StatusForbidden,
+		},
+		{
+			name:       "no encoding",
+			wantStatus: http.StatusOK,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("hello"))
+			if tc.transferEncoding != nil {
+				req.TransferEncoding = tc.transferEncoding
+				req.ContentLength = -1
+			}
+			w := serve(req, ok, Middleware(waf))
+			if w.Code != tc.wantStatus {
+				t.Errorf("status: got %d, want %d", w.Code, tc.wantStatus)
+			}
+		})
+	}
+}
+
+func TestHighestSeverityRule(t *testing.T) {
+	waf := newTestWAF(t, `
+		SecRuleEngine On
+		SecRule REQUEST_URI "@contains warn" "id:1,phase:1,pass,log,severity:WARNING"
+		SecRule REQUEST_URI "@contains crit" "id:2,phase:1,pass,log,severity:CRITICAL"
+		SecRule REQUEST_URI "@contains none" "id:3,phase:1,pass,log,msg:'no severity:here, nor severity:WARNING'"
+		SecRule REQUEST_URI "@rx \"?severity:CRITICAL" "id:4,phase:1,pass,log"
+		SecRule REQUEST_URI "@contains chain" "id:5,phase:1,pass,log,severity:ERROR,chain"
+			SecRule REQUEST_METHOD "@streq GET" "t:none"
+		SecRule REQUEST_URI "@contains link" "id:6,phase:1,pass,log,chain"
+			SecRule REQUEST_METHOD "@streq GET" "severity:EMERGENCY"
+	`)
+
+	cases := []struct {
+		name   string
+		path   string
+		wantID int
+	}{
+		{
+			name:   "single rule",
+			path:   "/warn",
+			wantID: 1,
+		},
+		{
+			name:   "most severe rule",
+			path:   "/warn/crit",
+			wantID: 2,
+		},
+		{
+			name:   "rule without severity is ignored",
+			path:   "/warn/none",
+			wantID: 1,
+		},
+		{
+			name:   "chained rule",
+			path:   "/warn/chain",
+			wantID: 5,
+		},
+		{
+			name: "only rules without severity",
+			path: "/none/severity:CRITICAL/link",
+		},
+		{
+			name: "no rule matched",
+			path: "/",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var during, after int
+			h := func(c fox.Context) {
+				if mr, ok := HighestSeverityRule(c); ok {
+					during = mr.Rule().ID()
+				}
+				c.Writer().WriteHeader(http.StatusOK)
+			}
+			mw := Middleware(waf, WithFinalStatus(func(c fox.Context, status int, interrupted bool) {
+				if mr, ok := HighestSeverityRule(c); ok {
+					after = mr.Rule().ID()
+				}
+			}))
+			serve(httptest.NewRequest(http.MethodGet, tc.path, nil), h, mw)
+			if during != tc.wantID {
+				t.Errorf("from the handler: got rule %d, want %d", during, tc.wantID)
+			}
+			if after != tc.wantID {
+				t.Errorf("once closed: got rule %d, want %d", after, tc.wantID)
+			}
+		})
+	}
+}
+
+func TestRemoteAddr(t *testing.T) {
+	cases := []struct {
+		name       string
+		remoteAddr string
+		wantClient string
+		wantPort   int
+	}{
+		{
+			name:       "ipv4 with port",
+			remoteAddr: "192.0.2.1:1234",
+			wantClient: "192.0.2.1",
+			wantPort:   1234,
+		},
+		{
+			name:       "ipv4 without port",
+			remoteAddr: "192.0.2.1",
+			wantClient: "192.0.2.1",
+		},
+		{
+			name:       "ipv6 with port",
+			remoteAddr: "[2001:db8::1]:8080",
+			wantClient: "2001:db8::1",
+			wantPort:   8080,
+		},
+		{
+			name:       "ipv6 without port",
+			remoteAddr: "2001:db8::1",
+			wantClient: "2001:db8::1",
+		},
+		{
+			name:       "bracketed ipv6 without port",
+			remoteAddr: "[2001:db8::1]",
+			wantClient: "2001:db8::1",
+		},
+		{
+			name:       "unix socket",
+			remoteAddr: "@",
+		},
+		{
+			name: "empty",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tc.remoteAddr
+			client, port := remoteAddr(req)
+			if client != tc.wantClient {
+				t.Errorf("client: got %q, want %q", client, tc.wantClient)
+			}
+			if port != tc.wantPort {
+				t.Errorf("port: got %d, want %d", port, tc.wantPort)
+			}
+		})
+	}
+}
+
+func TestClientIP_IPv6(t *testing.T) {
+	waf := newTestWAF(t, `
+		SecRuleEngine On
+		SecRule REMOTE_ADDR "@ipMatch 2001:db8::/32" "id:1,phase:1,deny,status:403"
+	`)
+
+	cases := []struct {
+		name       string
+		remoteAddr string
+		wantStatus int
+	}{
+		{
+			name:       "ipv6 with port",
+			remoteAddr: "[2001:db8::1]:8080",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "ipv6 without port",
+			remoteAddr: "2001:db8::1",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "other ipv6",
+			remoteAddr: "[2001:db9::1]:8080",
+			wantStatus: http.StatusOK,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tc.remoteAddr
+			w := serve(req, ok, Middleware(waf))
+			if w.Code != tc.wantStatus {
+				t.Errorf("status: got %d, want %d", w.Code, tc.wantStatus)
+			}
+		})
+	}
+}
+
+func TestRegisterAuditLogWriter(t *testing.T) {
+	var buf bytes.Buffer
+	RegisterAuditLogWriter("foxwaf-test", &buf)
+
+	// Each WAF keeps its own formatter, although both share the same writer.
+	newAuditedWAF := func(format string) coraza.WAF {
+		return newTestWAF(t, fmt.Sprintf(`
+			SecRuleEngine On
+			SecAuditEngine On
+			SecAuditLogParts ABZ
+			SecAuditLogType foxwaf-test
+			SecAuditLogFormat %s
+		`, format))
+	}
+	jsonWAF := newAuditedWAF("JSON")
+	nativeWAF := newAuditedWAF("Native")
+
+	cases := []struct {
+		name       string
+		waf        coraza.WAF
+		wantPrefix string
+	}{
+		{
+			name:       "json formatter",
+			waf:        jsonWAF,
+			wantPrefix: "{",
+		},
+		{
+			name:       "native formatter",
+			waf:        nativeWAF,
+			wantPrefix: "--",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			buf.Reset()
+			serve(httptest.NewRequest(http.MethodGet, "/", nil), ok, Middleware(tc.waf))
+			if !strings.HasPrefix(buf.String(), tc.wantPrefix) {
+				t.Errorf("audit log: got %q, want prefix %q", buf.String(), tc.wantPrefix)
+			}
+			if !strings.HasSuffix(buf.String(), "\n") {
+				t.Errorf("audit log: got %q, want a trailing newline", buf.String())
+			}
+		})
+	}
+}
+
+func TestRegisterAuditLogWriter_ReservedName(t *testing.T) {
+	for _, name := range []string{"serial", "concurrent", "https", "Serial"} {
+		t.Run(name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("expected a panic")
+				}
+			}()
+			RegisterAuditLogWriter(name, io.Discard)
+		})
+	}
+}
+
+// headerRecordingWAF is a Coraza WAF whose transactions record the names of the request headers they are fed, in order.
+type headerRecordingWAF struct {
+	coraza.WAF
+	names *[]string
+}
+
+func (w headerRecordingWAF) NewTransaction() types.Transaction {
+	return headerRecordingTX{Transaction: w.WAF.NewTransaction(), names: w.names}
+}
+
+type headerRecordingTX struct {
+	types.Transaction
+	names *[]string
+}
+
+func (tx headerRecordingTX) AddRequestHeader(key, value string) {
+	*tx.names = append(*tx.names, key)
+	tx.Transaction.AddRequestHeader(key, value)
+}
+
+func TestWithSortedRequestHeaders(t *testing.T) {
+	headers := []string{"X-Delta", "Accept", "X-Charlie", "User-Agent", "X-Bravo", "X-Alpha", "Cookie", "Referer"}
+
+	cases := []struct {
+		name       string
+		enable     bool
+		wantSorted bool
+	}{
+		{
+			name:       "sorted",
+			enable:     true,
+			wantSorted: true,
+		},
+		{
+			name: "not sorted",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var names []string
+			waf := headerRecordingWAF{WAF: newTestWAF(t, "SecRuleEngine On"), names: &names}
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			for _, name := range headers {
+				req.Header.Set(name, "value")
+			}
+			serve(req, ok, Middleware(waf, WithSortedRequestHeaders(tc.enable)))
+
+			var fed []string
+			for _, name := range names {
+				if slices.Contains(headers, name) {
+					fed = append(fed, name)
+				}
+			}
+			if len(fed) != len(headers) {
+				t.Fatalf("fed headers: got %v, want all of %v", fed, headers)
+			}
+			if tc.wantSorted && !slices.IsSorted(fed) {
+				t.Errorf("fed headers: got %v, want sorted", fed)
+			}
+		})
+	}
+}
+
+func TestWAF_RuleStats(t *testing.T) {
+	directives := `
+		SecRuleEngine On
+		SecRule REQUEST_URI "@contains probe" "id:1,phase:1,pass,log"
+		SecRule REQUEST_URI "@contains attack" "id:2,phase:1,deny,status:403"
+	`
+
+	cases := []struct {
+		name   string
+		enable bool
+		paths  []string
+		want   map[int]uint64
+	}{
+		{
+			name:   "counts across requests",
+			enable: true,
+			paths:  []string{"/probe", "/probe/attack", "/", "/attack"},
+			want:   map[int]uint64{1: 2, 2: 2},
+		},
+		{
+			name:   "no match",
+			enable: true,
+			paths:  []string{"/"},
+			want:   map[int]uint64{},
+		},
+		{
+			name:  "disabled",
+			paths: []string{"/probe"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := NewWAF(newTestWAF(t, directives), WithRuleStats(tc.enable))
+			for _, path := range tc.paths {
+				serve(httptest.NewRequest(http.MethodGet, path, nil), ok, w.Intercept)
+			}
+			got := w.RuleStats()
+			if (got == nil) != (tc.want == nil) || !maps.Equal(got, tc.want) {
+				t.Errorf("rule stats: got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func BenchmarkIntercept(b *testing.B) {
+	waf := newTestWAF(b, `
+		SecRuleEngine On
+		SecRequestBodyAccess On
+		SecRule REQUEST_URI "@contains attack" "id:1,phase:1,deny,status:403"
+		SecRule REQUEST_BODY "@contains attack" "id:2,phase:2,deny,status:403"
+	`)
+	body := strings.Repeat("a", 1024)
+
+	cases := []struct {
+		name string
+		body string
+		opts []Option
+	}{
+		{
+			name: "no body",
+		},
+		{
+			name: "body",
+			body: body,
+		},
+		{
+			name: "sorted headers",
+			opts: []Option{WithSortedRequestHeaders(true)},
+		},
+	}
+
+	for _, tc := range cases {
+		b.Run(tc.name, func(b *testing.B) {
+			f := fox.New(fox.WithMiddleware(Middleware(waf, tc.opts...)))
+			f.MustHandle(http.MethodPost, "/", ok)
+			w := httptest.NewRecorder()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for range b.N {
+				req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tc.body))
+				req.Header.Set("User-Agent", "foxwaf")
+				req.Header.Set("Accept", "*/*")
+				f.ServeHTTP(w, req)
+			}
+		})
+	}
+}
+
+func BenchmarkRequestBody(b *testing.B) {
+	waf := newTestWAF(b, `
+		SecRuleEngine On
+		SecRequestBodyAccess On
+		SecRequestBodyLimit 4096
+		SecRequestBodyLimitAction ProcessPartial
+	`)
+	h := func(c fox.Context) {
+		_, _ = io.Copy(io.Discard, c.Request().Body)
+		c.Writer().WriteHeader(http.StatusOK)
+	}
+
+	// A body entirely consumed by the inspection is served as is, while a larger one is followed by the bytes past the
+	// Coraza limit.
+	cases := []struct {
+		name          string
+		size          int
+		unknownLength bool
+	}{
+		{name: "consumed", size: 2048},
+		{name: "consumed chunked", size: 2048, unknownLength: true},
+		{name: "partial", size: 8192},
+		{name: "partial chunked", size: 8192, unknownLength: true},
+	}
+
+	for _, tc := range cases {
+		b.Run(tc.name, func(b *testing.B) {
+			f := fox.New(fox.WithMiddleware(Middleware(waf)))
+			f.MustHandle(http.MethodPost, "/", h)
+			body := strings.Repeat("a", tc.size)
+			w := httptest.NewRecorder()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for range b.N {
+				req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+				if tc.unknownLength {
+					req.ContentLength = -1
+				}
+				f.ServeHTTP(w, req)
+			}
+		})
+	}
+}
+
+func TestWithTransactionInit(t *testing.T) {
+	waf := newTestWAF(t, `
+		SecRuleEngine On
+		SecRule REQUEST_URI "@contains attack" "id:1,phase:1,deny,status:403"
+	`)
+
+	cases := []struct {
+		name       string
+		init       func(r *http.Request, tx types.Transaction)
+		wantStatus int
+	}{
+		{
+			name:       "no init",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name: "rule removed",
+			init: func(r *http.Request, tx types.Transaction) {
+				tx.(interface{ RemoveRuleByID(id int) }).RemoveRuleByID(1)
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name: "other rule removed",
+			init: func(r *http.Request, tx types.Transaction) {
+				tx.(interface{ RemoveRuleByID(id int) }).RemoveRuleByID(2)
+			},
+			wantStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/attack", nil)
+			w := serve(req, ok, Middleware(waf, WithTransactionInit(tc.init)))
+			if w.Code != tc.wantStatus {
+				t.Errorf("status: got %d, want %d", w.Code, tc.wantStatus)
+			}
+		})
+	}
+}
+
+func TestMalformedChunkedEncoding(t *testing.T) {
+	waf := newTestWAF(t, "SecRuleEngine On\nSecRequestBodyAccess On")
+
+	cases := []struct {
+		name       string
+		body       string
+		wantStatus int
+	}{
+		{
+			name:       "valid chunked body",
+			body:       "5\r\nhello\r\n0\r\n\r\n",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "invalid byte in chunk length",
+			body:       "zz\r\nhello\r\n0\r\n\r\n",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "missing chunk terminator",
+			body:       "5\r\nhelloXX0\r\n\r\n",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "chunk length too large",
+			body:       "ffffffffffffffffffff\r\nhello\r\n0\r\n\r\n",
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// The request is parsed by net/http, so the body is decoded by its chunked reader.
+			raw := "POST / HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n" + tc.body
+			req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(raw)))
+			if err != nil {
+				t.Fatalf("failed to read the request: %v", err)
+			}
+			w := serve(req, ok, Middleware(waf))
+			if w.Code != tc.wantStatus {
+				t.Errorf("status: got %d, want %d", w.Code, tc.wantStatus)
+			}
+		})
+	}
+}
+
+func TestMalformedChunkedEncoding_Server(t *testing.T) {
+	f := fox.New(fox.WithMiddleware(Middleware(newTestWAF(t, "SecRuleEngine On\nSecRequestBodyAccess On"))))
+	f.MustHandle(http.MethodPost, "/", ok)
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial the server: %v", err)
+	}
+	defer conn.Close()
+	_, err = io.WriteString(conn, "POST / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\nhello\r\n0\r\n\r\n")
+	if err != nil {
+		t.Fatalf("failed to write the request: %v", err)
+	}
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("failed to read the response: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("status: got %d, want %d", res.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestWAF_InspectRequest(t *testing.T) {
+	w := NewWAF(newTestWAF(t, `
+		SecRuleEngine On
+		SecRequestBodyAccess On
+		SecAction "id:1,phase:1,pass,nolog,ctl:forceRequestBodyVariable=On"
+		SecRule REQUEST_URI "@contains attack" "id:2,phase:1,deny,status:403"
+		SecRule REQUEST_BODY "@contains attack" "id:3,phase:2,deny,status:406"
+	`), WithMaxCookies(1, 0, 0))
+
+	cases := []struct {
+		name       string
+		path       string
+		body       string
+		cookies    string
+		wantPhase  types.RulePhase
+		wantStatus int
+		wantRuleID int
+	}{
+		{
+			name:       "uri interruption",
+			path:       "/attack",
+			wantPhase:  types.PhaseRequestHeaders,
+			wantStatus: http.StatusForbidden,
+			wantRuleID: 2,
+		},
+		{
+			name:       "body interruption",
+			path:       "/",
+			body:       "attack",
+			wantPhase:  types.PhaseRequestBody,
+			wantStatus: http.StatusNotAcceptable,
+			wantRuleID: 3,
+		},
+		{
+			name:       "interruption not tied to a rule",
+			path:       "/",
+			cookies:    "a=1; b=2",
+			wantPhase:  types.PhaseRequestHeaders,
+			wantStatus: 0,
+		},
+		{
+			name:      "allowed request",
+			path:      "/",
+			body:      "hello",
+			wantPhase: types.PhaseUnknown,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tc.path, strings.NewReader(tc.body))
+			if tc.cookies != "" {
+				req.Header.Set("Cookie", tc.cookies)
+			}
+			res, err := w.InspectRequest(req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if res.Phase != tc.wantPhase {
+				t.Errorf("phase: got %d, want %d", res.Phase, tc.wantPhase)
+			}
+			if tc.wantPhase == types.PhaseUnknown {
+				if res.Interruption != nil || res.Rule != nil {
+					t.Errorf("result: got %+v, want no interruption", res)
+				}
+				if b, _ := io.ReadAll(req.Body); string(b) != tc.body {
+					t.Errorf("body: got %q, want %q", b, tc.body)
+				}
+				return
+			}
+			if res.Interruption == nil || res.Interruption.Status != tc.wantStatus {
+				t.Fatalf("interruption: got %+v, want status %d", res.Interruption, tc.wantStatus)
+			}
+			switch {
+			case tc.wantRuleID == 0 && res.Rule != nil:
+				t.Errorf("rule: got %d, want none", res.Rule.Rule().ID())
+			case tc.wantRuleID != 0 && (res.Rule == nil || res.Rule.Rule().ID() != tc.wantRuleID):
+				t.Errorf("rule: got %v, want %d", res.Rule, tc.wantRuleID)
+			}
+		})
+	}
+}
+
+func TestWithRequestBodyLimitReject(t *testing.T) {
+	waf := newTestWAF(t, `
+		SecRuleEngine On
+		SecRequestBodyAccess On
+		SecRequestBodyLimit 16
+		SecRequestBodyLimitAction ProcessPartial
+	`)
+	mw := Middleware(waf, WithRequestBodyLimitReject(func(c fox.Context) bool {
+		for a := range c.Route().Annotations() {
+			if a.Key == "waf.reject_over_limit" {
+				return true
+			}
+		}
+		return false
+	}))
+
+	var got string
+	echo := func(c fox.Context) {
+		b, _ := io.ReadAll(c.Request().Body)
+		got = string(b)
+	}
+	f := fox.New(fox.WithMiddleware(mw))
+	f.MustHandle(http.MethodPost, "/upload", echo, fox.WithAnnotations(fox.Annotation{Key: "waf.reject_over_limit", Value: true}))
+	f.MustHandle(http.MethodPost, "/events", echo)
+
+	cases := []struct {
+		name       string
+		path       string
+		body       string
+		wantStatus int
+	}{
+		{
+			name:       "rejecting route with a body under the limit",
+			path:       "/upload",
+			body:       "small",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "rejecting route with a body over the limit",
+			path:       "/upload",
+			body:       strings.Repeat("a", 32),
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:       "partial route with a body over the limit",
+			path:       "/events",
+			body:       strings.Repeat("a", 32),
+			wantStatus: http.StatusOK,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got = ""
+			w := httptest.NewRecorder()
+			f.ServeHTTP(w, httptest.NewRequest(http.MethodPost, tc.path, strings.NewReader(tc.body)))
+			if w.Code != tc.wantStatus {
+				t.Errorf("status: got %d, want %d", w.Code, tc.wantStatus)
+			}
+			if tc.wantStatus == http.StatusOK && got != tc.body {
+				t.Errorf("body: got %q, want %q", got, tc.body)
+			}
+		})
+	}
+}
+
+func TestWithRuleExclusionResolver(t *testing.T) {
+	waf := newTestWAF(t, `
+		SecRuleEngine On
+		SecRule ARGS:q "@contains attack" "id:1,phase:1,deny,status:403,tag:'attack-sqli'"
+		SecRule ARGS:q "@contains attack" "id:2,phase:1,deny,status:406,tag:'attack-xss',tag:'paranoia-level/2'"
+	`)
+	mw := Middleware(waf, WithRuleExclusionResolver(func(c fox.Context) (ids []int, tags []string) {
+		for a := range c.Route().Annotations() {
+			switch a.Key {
+			case "waf.exclude_ids":
+				ids = append(ids, a.Value.([]int)...)
+			case "waf.exclude_tags":
+				tags = append(tags, a.Value.([]string)...)
+			}
+		}
+		return ids, tags
+	}))
+
+	f := fox.New(fox.WithMiddleware(mw))
+	f.MustHandle(http.MethodGet, "/search", ok)
+	f.MustHandle(http.MethodGet, "/upload", ok, fox.WithAnnotations(fox.Annotation{Key: "waf.exclude_ids", Value: []int{1}}))
+	f.MustHandle(http.MethodGet, "/webhook", ok, fox.WithAnnotations(fox.Annotation{Key: "waf.exclude_tags", Value: []string{"attack-sqli"}}))
+	f.MustHandle(http.MethodGet, "/import", ok, fox.WithAnnotations(
+		fox.Annotation{Key: "waf.exclude_ids", Value: []int{1}},
+		fox.Annotation{Key: "waf.exclude_tags", Value: []string{"paranoia-level/2"}},
+	))
+	f.MustHandle(http.MethodGet, "/export", ok, fox.WithAnnotations(fox.Annotation{Key: "waf.exclude_tags", Value: []string{"unknown"}}))
+
+	cases := []struct {
+		name       string
+		path       string
+		wantStatus int
+	}{
+		{
+			name:       "no exclusion",
+			path:       "/search",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "excluded by id",
+			path:       "/upload",
+			wantStatus: http.StatusNotAcceptable,
+		},
+		{
+			name:       "excluded by tag",
+			path:       "/webhook",
+			wantStatus: http.StatusNotAcceptable,
+		},
+		{
+			name:       "excluded by id and tag",
+			path:       "/import",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "unknown tag",
+			path:       "/export",
+			wantStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			f.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.path+"?q=attack", nil))
+			if w.Code != tc.wantStatus {
+				t.Errorf("status: got %d, want %d", w.Code, tc.wantStatus)
+			}
+		})
+	}
+}
+
+func TestRuleTags(t *testing.T) {
+	waf := newTestWAF(t, `
+		SecRule ARGS "@rx a" "id:1,phase:1,pass,nolog,tag:'a',tag:'b'"
+		SecRule ARGS "@rx b" "id:2,phase:1,pass,nolog,tag:'b'"
+		SecRule ARGS "@rx c" "id:3,phase:1,pass,nolog"
+	`)
+	tags := ruleTags(waf)
+	want := map[string][]int{"a": {1}, "b": {1, 2}}
+	if !maps.EqualFunc(tags, want, slices.Equal[[]int]) {
+		t.Errorf("tags: got %v, want %v", tags, want)
+	}
+	if got := ruleTags(brokenWAF{}); got != nil {
+		t.Errorf("tags of an unknown WAF: got %v, want nil", got)
+	}
+}
+
+// brokenWAF is a Coraza WAF failing to create transactions.
+type brokenWAF struct {
+	coraza.WAF
+}
+
+func (brokenWAF) NewTransaction() types.Transaction {
+	return nil
+}
+
+func TestWithFailClosed(t *testing.T) {
+	cases := []struct {
+		name        string
+		failClosed  bool
+		wantStatus  int
+		wantHandler bool
+	}{
+		{
+			name:        "fail open",
+			wantStatus:  http.StatusOK,
+			wantHandler: true,
+		},
+		{
+			name:       "fail closed",
+			failClosed: true,
+			wantStatus: http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var called bool
+			h := func(c fox.Context) {
+				called = true
+				c.Writer().WriteHeader(http.StatusOK)
+			}
+			var final int
+			mw := Middleware(brokenWAF{}, WithFailClosed(tc.failClosed), WithFinalStatus(func(c fox.Context, status int, interrupted bool) {
+				final = status
+			}))
+			w := serve(httptest.NewRequest(http.MethodGet, "/", nil), h, mw)
+			if w.Code != tc.wantStatus {
+				t.Errorf("status: got %d, want %d", w.Code, tc.wantStatus)
+			}
+			if called != tc.wantHandler {
+				t.Errorf("handler called: got %t, want %t", called, tc.wantHandler)
+			}
+			if final != tc.wantStatus {
+				t.Errorf("final status: got %d, want %d", final, tc.wantStatus)
+			}
+		})
+	}
+}
+
+func TestWithFinalStatus(t *testing.T) {
+	waf := newTestWAF(t, `
+		SecRuleEngine On
+		SecRule ARGS:id "@eq 0" "id:1,phase:1,deny,status:403"
+	`)
+	offWAF := newTestWAF(t, "SecRuleEngine Off")
+	allowlist := []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}
+
+	type call struct {
+		status      int
+		interrupted bool
+	}
+	cases := []struct {
+		name       string
+		target     string
+		remoteAddr string
+		mws        func(fn func(c fox.Context, status int, interrupted bool)) []fox.MiddlewareFunc
+		wantCalls  []call
+	}{
+		{
+			name:   "inspected request",
+			target: "/",
+			mws: func(fn func(c fox.Context, status int, interrupted bool)) []fox.MiddlewareFunc {
+				return []fox.MiddlewareFunc{Middleware(waf, WithFinalStatus(fn))}
+			},
+			wantCalls: []call{{http.StatusOK, false}},
+		},
+		{
+			name:   "blocked request",
+			target: "/?id=0",
+			mws: func(fn func(c fox.Context, status int, interrupted bool)) []fox.MiddlewareFunc {
+				return []fox.MiddlewareFunc{Middleware(waf, WithFinalStatus(fn))}
+			},
+			wantCalls: []call{{http.StatusForbidden, true}},
+		},
+		{
+			name:   "rule engine off",
+			target: "/?id=0",
+			mws: func(fn func(c fox.Context, status int, interrupted bool)) []fox.MiddlewareFunc {
+				return []fox.MiddlewareFunc{Middleware(offWAF, WithFinalStatus(fn))}
+			},
+			wantCalls: []call{{http.StatusOK, false}},
+		},
+		{
+			name:   "skipped request",
+			target: "/?id=0",
+			mws: func(fn func(c fox.Context, status int, interrupted bool)) []fox.MiddlewareFunc {
+				return []fox.MiddlewareFunc{Middleware(waf, WithFinalStatus(fn), WithSkipper(func(c fox.Context) bool {
+					return true
+				}))}
+			},
+			wantCalls: []call{{http.StatusOK, false}},
+		},
+		{
+			name:   "unsampled request",
+			target: "/?id=0",
+			mws: func(fn func(c fox.Context, status int, interrupted bool)) []fox.MiddlewareFunc {
+				return []fox.MiddlewareFunc{Middleware(waf, WithFinalStatus(fn), WithRequestSampling(0))}
+			},
+			wantCalls: []call{{http.StatusOK, false}},
+		},
+		{
+			name:       "allowlisted client",
+			target:     "/?id=0",
+			remoteAddr: "192.0.2.1:1234",
+			mws: func(fn func(c fox.Context, status int, interrupted bool)) []fox.MiddlewareFunc {
+				return []fox.MiddlewareFunc{Middleware(waf, WithFinalStatus(fn), WithIPAllowlist(allowlist))}
+			},
+			wantCalls: []call{{http.StatusOK, false}},
+		},
+		{
+			name:   "same instance applied twice",
+			target: "/",
+			mws: func(fn func(c fox.Context, status int, interrupted bool)) []fox.MiddlewareFunc {
+				mw := Middleware(waf, WithFinalStatus(fn))
+				return []fox.MiddlewareFunc{mw, mw}
+			},
+			wantCalls: []call{{http.StatusOK, false}},
+		},
+		{
+			name:   "request already inspected by an upstream WAF",
+			target: "/",
+			mws: func(fn func(c fox.Context, status int, interrupted bool)) []fox.MiddlewareFunc {
+				return []fox.MiddlewareFunc{Middleware(waf), Middleware(waf, WithFinalStatus(fn))}
+			},
+			wantCalls: []call{{http.StatusOK, false}},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var calls []call
+			fn := func(c fox.Context, status int, interrupted bool) {
+				calls = append(calls, call{status, interrupted})
+			}
+			req := httptest.NewRequest(http.MethodGet, tc.target, nil)
+			if tc.remoteAddr != "" {
+				req.RemoteAddr = tc.remoteAddr
+			}
+			serve(req, ok, tc.mws(fn)...)
+			if !slices.Equal(calls, tc.wantCalls) {
+				t.Errorf("calls: got %+v, want %+v", calls, tc.wantCalls)
+			}
+		})
+	}
+}
+
+func TestNewWAF_Options(t *testing.T) {
+	waf := newTestWAF(t, `
+		SecRuleEngine On
+		SecRule ARGS:id "@eq 0" "id:1,phase:1,deny,status:403"
+	`)
+
+	cases := []struct {
+		name     string
+		opts     []Option
+		wantBody string
+	}{
+		{
+			name: "defaults without option",
+		},
+		{
+			name:     "option applied",
+			opts:     []Option{WithBlockBody([]byte("blocked"), "text/plain")},
+			wantBody: "blocked",
+		},
+		{
+			name:     "last option wins",
+			opts:     []Option{WithBlockBody([]byte("blocked"), "text/plain"), WithBlockBody([]byte("denied"), "text/plain")},
+			wantBody: "denied",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			for name, mw := range map[string]fox.MiddlewareFunc{
+				"Middleware": Middleware(waf, tc.opts...),
+				"NewWAF":     NewWAF(waf, tc.opts...).Intercept,
+			} {
+				w := serve(httptest.NewRequest(http.MethodGet, "/?id=0", nil), ok, mw)
+				if w.Code != http.StatusForbidden {
+					t.Errorf("%s status: got %d, want %d", name, w.Code, http.StatusForbidden)
+				}
+				if w.Body.String() != tc.wantBody {
+					t.Errorf("%s body: got %q, want %q", name, w.Body.String(), tc.wantBody)
+				}
+			}
+		})
+	}
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += n
+	return n, err
+}
+
+func TestStreamingUploadReadUpToLimit(t *testing.T) {
+	const limit = 1024
+	waf := newTestWAF(t, fmt.Sprintf(`
+		SecRuleEngine On
+		SecRequestBodyAccess On
+		SecRequestBodyLimit %d
+		SecRequestBodyLimitAction ProcessPartial
+		SecAction "id:1,phase:1,pass,nolog,ctl:forceRequestBodyVariable=on"
+		SecRule REQUEST_BODY "@contains attack" "id:2,phase:2,deny,status:403"
+	`, limit))
+
+	body := &countingReader{r: io.MultiReader(strings.NewReader("attack"), strings.NewReader(strings.Repeat("a", 1<<20)))}
+	req := httptest.NewRequest(http.MethodPost, "/", body)
+	req.ContentLength = -1
+	var called bool
+	w := serve(req, func(c fox.Context) {
+		called = true
+	}, Middleware(waf))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("status: got %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if called {
+		t.Error("the handler must not be called")
+	}
+	if body.n > limit {
+		t.Errorf("read: got %d bytes, want at most %d", body.n, limit)
+	}
+}
+
+func TestWithTrustedProxies(t *testing.T) {
+	resolve := trustedProxiesResolver([]netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("fd00::/8"),
+	})
+
+	cases := []struct {
+		name       string
+		remoteAddr string
+		xff        []string
+		wantClient string
+		wantPort   int
+	}{
+		{
+			name:       "untrusted peer",
+			remoteAddr: "198.51.100.1:1234",
+			xff:        []string{"203.0.113.7"},
+			wantClient: "198.51.100.1",
+			wantPort:   1234,
+		},
+		{
+			name:       "trusted peer",
+			remoteAddr: "10.0.0.1:1234",
+			xff:        []string{"203.0.113.7"},
+			wantClient: "203.0.113.7",
+		},
+		{
+			name:       "first untrusted hop from the right",
+			remoteAddr: "10.0.0.1:1234",
+			xff:        []string{"192.0.2.1, 203.0.113.7", "10.0.0.2"},
+			wantClient: "203.0.113.7",
+		},
+		{
+			name:       "all hops trusted",
+			remoteAddr: "10.0.0.1:1234",
+			xff:        []string{"10.0.0.3, 10.0.0.2"},
+			wantClient: "10.0.0.3",
+		},
+		{
+			name:       "missing header",
+			remoteAddr: "10.0.0.1:1234",
+			wantClient: "10.0.0.1",
+			wantPort:   1234,
+		},
+		{
+			name:       "empty header",
+			remoteAddr: "10.0.0.1:1234",
+			xff:        []string{""},
+			wantClient: "10.0.0.1",
+			wantPort:   1234,
+		},
+		{
+			name:       "malformed hop",
+			remoteAddr: "10.0.0.1:1234",
+			xff:        []string{"203.0.113.7, not-an-ip"},
+			wantClient: "10.0.0.1",
+			wantPort:   1234,
+		},
+		{
+			name:       "hop with a port",
+			remoteAddr: "10.0.0.1:1234",
+			xff:        []string{"[2001:db8::1]:8080"},
+			wantClient: "2001:db8::1",
+		},
+		{
+			name:       "zoned IPv6 hop",
+			remoteAddr: "10.0.0.1:1234",
+			xff:        []string{"fe80::1%eth0"},
+			wantClient: "fe80::1",
+		},
+		{
+			name:       "zoned IPv6 peer",
+			remoteAddr: "[fd00::1%eth0]:1234",
+			xff:        []string{"203.0.113.7"},
+			wantClient: "203.0.113.7",
+		},
+		{
+			name:       "trusted zoned IPv6 hop",
+			remoteAddr: "10.0.0.1:1234",
+			xff:        []string{"203.0.113.7, fd00::2%eth0"},
+			wantClient: "203.0.113.7",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tc.remoteAddr
+			for _, v := range tc.xff {
+				req.Header.Add("X-Forwarded-For", v)
+			}
+			client, port := resolve(req)
+			if client != tc.wantClient || port != tc.wantPort {
+				t.Errorf("client: got %s:%d, want %s:%d", client, port, tc.wantClient, tc.wantPort)
+			}
+		})
+	}
+
+	t.Run("client fed to Coraza", func(t *testing.T) {
+		waf := newTestWAF(t, `
+			SecRuleEngine On
+			SecRule REMOTE_ADDR "@ipMatch 203.0.113.7" "id:1,phase:1,deny,status:403"
+		`)
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("X-Forwarded-For", "203.0.113.7")
+		w := serve(req, ok, Middleware(waf, WithTrustedProxies(netip.MustParsePrefix("10.0.0.0/8"))))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("status: got %d, want %d", w.Code, http.StatusForbidden)
+		}
+	})
+}
+
+func TestWithDefaultDenyStatus(t *testing.T) {
+	waf := newTestWAF(t, `
+		SecRuleEngine On
+		SecResponseBodyAccess On
+		SecResponseBodyMimeType text/plain
+		SecRule ARGS:id "@eq 1" "id:1,phase:1,deny"
+		SecRule ARGS:id "@eq 2" "id:2,phase:1,deny,status:403"
+		SecRule RESPONSE_BODY "@contains secret" "id:3,phase:4,deny"
+	`)
+	secret := func(c fox.Context) {
+		c.Writer().Header().Set("Content-Type", "text/plain")
+		_, _ = c.Writer().Write([]byte("a secret"))
+	}
+
+	cases := []struct {
+		name       string
+		opts       []Option
+		target     string
+		cookie     string
+		h          fox.HandlerFunc
+		wantStatus int
+	}{
+		{
+			name:       "rule without status",
+			opts:       []Option{WithDefaultDenyStatus(http.StatusNotAcceptable)},
+			target:     "/?id=1",
+			h:          ok,
+			wantStatus: http.StatusNotAcceptable,
+		},
+		{
+			name:       "rule with an explicit 403",
+			opts:       []Option{WithDefaultDenyStatus(http.StatusNotAcceptable)},
+			target:     "/?id=2",
+			h:          ok,
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "response rule without status",
+			opts:       []Option{WithDefaultDenyStatus(http.StatusNotAcceptable)},
+			target:     "/",
+			h:          secret,
+			wantStatus: http.StatusNotAcceptable,
+		},
+		{
+			name:       "cookie limit without status",
+			opts:       []Option{WithDefaultDenyStatus(http.StatusNotAcceptable), WithMaxCookies(1, 0, 0)},
+			target:     "/",
+			cookie:     "a=1; b=2",
+			h:          ok,
+			wantStatus: http.StatusNotAcceptable,
+		},
+		{
+			name:       "cookie limit with its own status",
+			opts:       []Option{WithDefaultDenyStatus(http.StatusNotAcceptable), WithMaxCookies(1, 0, http.StatusBadRequest)},
+			target:     "/",
+			cookie:     "a=1; b=2",
+			h:          ok,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "rule without status by default",
+			target:     "/?id=1",
+			h:          ok,
+			wantStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.target, nil)
+			if tc.cookie != "" {
+				req.Header.Set("Cookie", tc.cookie)
+			}
+			w := serve(req, tc.h, Middleware(waf, tc.opts...))
+			if w.Code != tc.wantStatus {
+				t.Errorf("status: got %d, want %d", w.Code, tc.wantStatus)
+			}
+		})
+	}
+}
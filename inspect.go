@@ -0,0 +1,101 @@
+// Copyright 2024 Sylvain Müller.
+// SPDX-License-Identifier: Apache-2.0
+
+package foxwaf
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/corazawaf/coraza/v3/types"
+	"io"
+	"net/http"
+)
+
+// Result holds the outcome of a standalone request inspection.
+type Result struct {
+	// Interruption is the interruption triggered by the request, or nil if the request is allowed.
+	Interruption *types.Interruption
+	// Rule is the matched rule that caused the interruption. It is nil if the request is allowed or if the
+	// interruption is not tied to a rule.
+	Rule types.MatchedRule
+	// Phase is the phase at which the request was interrupted, or types.PhaseUnknown if the request is allowed.
+	// Coraza evaluates the connection and URI variables with the request headers rules (phase:1), so a URI
+	// interruption is reported at types.PhaseRequestHeaders, and a body interruption at types.PhaseRequestBody.
+	Phase types.RulePhase
+}
+
+// InspectRequest runs the request phases of the WAF against r without serving it, which is useful for offline
+// analysis. The request body, if inspected, is reassembled so it can still be read by the caller.
+func (w *WAF) InspectRequest(r *http.Request) (Result, error) {
+	tx := w.newTX(r)
+	if tx == nil {
+		return Result{}, ErrNoTransaction
+	}
+	defer func() {
+		tx.ProcessLogging()
+		if err := tx.Close(); err != nil {
+			tx.DebugLogger().Error().Err(err).Msg("Failed to close the transaction")
+		}
+	}()
+
+	if w.cfg.txInit != nil {
+		w.cfg.txInit(r, tx)
+	}
+
+	if tx.IsRuleEngineOff() {
+		return Result{}, nil
+	}
+
+	client, cport := w.clientAddr(r)
+	it, phase, err := processRequest(tx, r, client, cport, false, nil, w.cfg)
+	if err != nil {
+		return Result{}, err
+	}
+	if err := detachBody(tx, r); err != nil {
+		return Result{}, err
+	}
+	if it == nil {
+		return Result{}, nil
+	}
+
+	return Result{
+		Interruption: it,
+		Rule:         interruptionRule(tx, it),
+		Phase:        phase,
+	}, nil
+}
+
+// interruptionRule returns the matched rule that caused the interruption, or nil if none.
+func interruptionRule(tx types.Transaction, it *types.Interruption) types.MatchedRule {
+	rules := tx.MatchedRules()
+	for i := len(rules) - 1; i >= 0; i-- {
+		if rules[i].Rule().ID() == it.RuleID {
+			return rules[i]
+		}
+	}
+	return nil
+}
+
+// detachBody copies the inspected bytes of the reassembled request body, which are read from the transaction buffer.
+// The buffer is released once the transaction is closed, while the caller may still read the body.
+func detachBody(tx types.Transaction, r *http.Request) error {
+	body, ok := r.Body.(reassembledBody)
+	if !ok {
+		if wt, isWriterTo := r.Body.(reassembledBodyWriterTo); isWriterTo {
+			body, ok = reassembledBody{wt.Reader, wt.Closer, wt.remainder}, true
+		}
+	}
+	if !ok || body.remainder == nil {
+		return nil
+	}
+	rbr, err := tx.RequestBodyReader()
+	if err != nil {
+		return fmt.Errorf("failed to get the request body: %w", err)
+	}
+	inspected, err := io.ReadAll(rbr)
+	if err != nil {
+		return fmt.Errorf("failed to copy the request body: %w", err)
+	}
+	r.Body = reassembledBody{io.MultiReader(bytes.NewReader(inspected), body.remainder), body.Closer, body.remainder}
+	return nil
+}
@@ -0,0 +1,59 @@
+// Copyright 2024 Sylvain Müller.
+// SPDX-License-Identifier: Apache-2.0
+
+package foxwaf
+
+import (
+	"net/netip"
+	"strings"
+	"sync/atomic"
+)
+
+// SetIPDenylist atomically replaces the list of client IP ranges blocked before any rule processing, as configured
+// with WithIPDenylist. It is safe to call while requests are being served, e.g. for incident response. An empty list
+// disables the denylist.
+func (w *WAF) SetIPDenylist(cidrs []netip.Prefix) {
+	w.cfg.ipDenylist.store(cidrs)
+}
+
+// SetIPAllowlist atomically replaces the list of client IP ranges bypassing the WAF, as configured with
+// WithIPAllowlist. It is safe to call while requests are being served. An empty list disables the allowlist.
+func (w *WAF) SetIPAllowlist(cidrs []netip.Prefix) {
+	w.cfg.ipAllowlist.store(cidrs)
+}
+
+// ipList is a runtime-updatable list of IP ranges.
+type ipList struct {
+	prefixes atomic.Pointer[[]netip.Prefix]
+}
+
+func (l *ipList) store(cidrs []netip.Prefix) {
+	if len(cidrs) == 0 {
+		l.prefixes.Store(nil)
+		return
+	}
+	prefixes := make([]netip.Prefix, len(cidrs))
+	for i, prefix := range cidrs {
+		prefixes[i] = prefix.Masked()
+	}
+	l.prefixes.Store(&prefixes)
+}
+
+// contains reports whether the client IP belongs to the list. Clients with an unparsable IP never do.
+func (l *ipList) contains(client string) bool {
+	prefixes := l.prefixes.Load()
+	if prefixes == nil {
+		return false
+	}
+	ip, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(client, "["), "]"))
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, prefix := range *prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+// Copyright 2024 Sylvain Müller.
+// SPDX-License-Identifier: Apache-2.0
+
+package foxwaf
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+var errJSONTooDeep = errors.New("json nesting depth limit exceeded")
+
+// isJSON reports whether the request body is declared as JSON.
+func isJSON(req *http.Request) bool {
+	mt := mediaType(req.Header.Get("Content-Type"))
+	return mt == "application/json" || strings.HasSuffix(mt, "+json")
+}
+
+// jsonDepthReader scans the JSON body as it is read and fails with errJSONTooDeep as soon as the nesting depth
+// exceeds max. The scan only tracks brackets outside of strings, it does not validate the body.
+type jsonDepthReader struct {
+	r        io.Reader
+	max      int
+	depth    int
+	inString bool
+	escaped  bool
+}
+
+func (r *jsonDepthReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	for _, c := range p[:n] {
+		if r.inString {
+			switch {
+			case r.escaped:
+				r.escaped = false
+			case c == '\\':
+				r.escaped = true
+			case c == '"':
+				r.inString = false
+			}
+			continue
+		}
+		switch c {
+		case '"':
+			r.inString = true
+		case '{', '[':
+			r.depth++
+			if r.depth > r.max {
+				return n, errJSONTooDeep
+			}
+		case '}', ']':
+			// Unbalanced closers must not give credit to the openers that follow them.
+			r.depth = max(r.depth-1, 0)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,63 @@
+// Copyright 2024 Sylvain Müller.
+// SPDX-License-Identifier: Apache-2.0
+
+package foxwaf
+
+import (
+	"github.com/corazawaf/coraza/v3/types"
+	"io"
+	"time"
+)
+
+// Recorder records metrics about the WAF processing. Implementations must be safe for concurrent use.
+type Recorder interface {
+	// ObserveRequestBodyBytes records n request body bytes that were either inspected by Coraza or passed through
+	// uninspected to the handler (body access disabled, beyond the body limit, unsupported content type, etc.).
+	ObserveRequestBodyBytes(n int, inspected bool)
+	// ObserveResponseBodyBytes records n response body bytes that were either inspected by Coraza or passed through
+	// uninspected to the client (body access disabled, content type not processable, etc.).
+	ObserveResponseBodyBytes(n int, inspected bool)
+	// ObserveDuration records, once per transaction, the time spent in the downstream handler and the overhead of the
+	// WAF, that is the remaining time spent in the middleware (all phases, buffering and logging included). The
+	// handler duration is zero if the request was interrupted before reaching the handler.
+	ObserveDuration(handler, overhead time.Duration)
+	// ObserveMatchedRules records, once per transaction, the number of rules matched across all phases. Coraza does
+	// not expose the number of evaluated rules, so the matched count is the closest measure of rule-heavy paths.
+	ObserveMatchedRules(n int)
+	// ObserveUnsampledRequest records a request passed through without inspection because it was not sampled.
+	ObserveUnsampledRequest()
+	// ObserveInterruption records an interruption at the given phase, caused by the given rule and action. The rule
+	// ID is zero if the interruption is not tied to a rule (e.g. rejected before inspection).
+	ObserveInterruption(phase types.RulePhase, ruleID int, action string)
+	// ObserveProcessingDuration records the time spent processing the request phases, reported as
+	// types.PhaseRequestBody, or the response body phase, reported as types.PhaseResponseBody.
+	ObserveProcessingDuration(phase types.RulePhase, d time.Duration)
+}
+
+var _ Recorder = NopRecorder{}
+
+// NopRecorder is a [Recorder] which records nothing. It can be embedded by implementations only interested in some of
+// the metrics. Not registering any recorder is equivalent to using a NopRecorder.
+type NopRecorder struct{}
+
+func (NopRecorder) ObserveRequestBodyBytes(int, bool)                        {}
+func (NopRecorder) ObserveResponseBodyBytes(int, bool)                       {}
+func (NopRecorder) ObserveDuration(time.Duration, time.Duration)             {}
+func (NopRecorder) ObserveMatchedRules(int)                                  {}
+func (NopRecorder) ObserveUnsampledRequest()                                 {}
+func (NopRecorder) ObserveInterruption(types.RulePhase, int, string)         {}
+func (NopRecorder) ObserveProcessingDuration(types.RulePhase, time.Duration) {}
+
+// passThroughReader records the request body bytes read by the handler without being inspected.
+type passThroughReader struct {
+	io.Reader
+	recorder Recorder
+}
+
+func (r passThroughReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.recorder.ObserveRequestBodyBytes(n, false)
+	}
+	return n, err
+}
@@ -0,0 +1,160 @@
+// Copyright 2024 Sylvain Müller.
+// SPDX-License-Identifier: Apache-2.0
+
+package foxwaf
+
+import (
+	"github.com/corazawaf/coraza/v3"
+	"github.com/corazawaf/coraza/v3/types"
+	"net/http"
+	"reflect"
+	"strconv"
+)
+
+const (
+	headerWouldBlock  = "X-WAF-Would-Block"
+	headerWouldStatus = "X-WAF-Would-Status"
+)
+
+// setWouldBlockHeaders sets the headers reporting the would-be verdict of a transaction running in DetectionOnly mode,
+// looking up the matched rules in the statuses returned by wouldBlockStatuses.
+func setWouldBlockHeaders(tx types.Transaction, h http.Header, statuses map[int]int) {
+	if tx.IsInterrupted() {
+		return
+	}
+	if status, ok := wouldBlock(tx, statuses); ok {
+		h.Set(headerWouldBlock, "true")
+		h.Set(headerWouldStatus, strconv.Itoa(status))
+	}
+}
+
+// wouldBlock reports whether any matched rule carries a disruptive action that would have interrupted the transaction
+// if the rule engine was not in DetectionOnly mode, along with the status code it would have returned. Coraza does not
+// record disruptive actions in DetectionOnly mode, so they are looked up in the statuses of the parsed rules.
+func wouldBlock(tx types.Transaction, statuses map[int]int) (int, bool) {
+	for _, mr := range tx.MatchedRules() {
+		if status, ok := statuses[mr.Rule().ID()]; ok {
+			return status, true
+		}
+	}
+	return 0, false
+}
+
+// wouldBlockStatuses returns the status code that each rule carrying a deny, drop or redirect action would return,
+// indexed by rule id. The deny status is used for deny and drop actions without status. It returns nil if the rules
+// can't be found.
+func wouldBlockStatuses(waf coraza.WAF, denyStatus int) map[int]int {
+	rules, ok := disruptiveRules(waf)
+	if !ok {
+		return nil
+	}
+	statuses := make(map[int]int)
+	for _, rule := range rules {
+		status := rule.status
+		switch rule.action {
+		case "deny", "drop":
+			if status == 0 {
+				status = denyStatus
+			}
+		case "redirect":
+			if status == 0 {
+				status = http.StatusFound
+			}
+		default:
+			continue
+		}
+		statuses[rule.id] = status
+	}
+	return statuses
+}
+
+// disruptiveRule is a rule parsed by Coraza, along with its disruptive action and status, if any.
+type disruptiveRule struct {
+	id     int
+	action string
+	status int
+}
+
+// disruptiveRules returns the rules parsed by the WAF carrying a disruptive action. A chained rule carries the
+// disruptive action of the whole chain, and a block action is resolved by Coraza to the disruptive action of the
+// matching SecDefaultAction when parsing the rule. Coraza does not expose the parsed rules, so they are read by
+// reflection in the WAF, which is meant to be done once. It reports false if the rules can't be found.
+func disruptiveRules(waf coraza.WAF) (rules []disruptiveRule, ok bool) {
+	defer func() {
+		// The Coraza internals may change, in which case the rules are treated as not found rather than panicking.
+		if recover() != nil {
+			rules, ok = nil, false
+		}
+	}()
+
+	parsed, ok := parsedRules(waf)
+	if !ok {
+		return nil, false
+	}
+	for i := range parsed.Len() {
+		rule := parsed.Index(i)
+		actions := rule.FieldByName("actions")
+		for j := range actions.Len() {
+			switch name := actions.Index(j).FieldByName("Name").String(); name {
+			case "allow", "deny", "drop", "pass", "redirect":
+				rules = append(rules, disruptiveRule{
+					id:     int(rule.FieldByName("ID_").Int()),
+					action: name,
+					status: int(rule.FieldByName("DisruptiveStatus").Int()),
+				})
+			default:
+				continue
+			}
+			break
+		}
+	}
+	return rules, true
+}
+
+// ruleTags returns the ids of the rules parsed by the WAF, indexed by tag, as matched by the ctl:ruleRemoveByTag action.
+// Like disruptiveRules, the rules are read by reflection in the WAF. It returns nil if the rules can't be found.
+func ruleTags(waf coraza.WAF) (tags map[string][]int) {
+	defer func() {
+		// The Coraza internals may change, in which case the rules are treated as not found rather than panicking.
+		if recover() != nil {
+			tags = nil
+		}
+	}()
+
+	parsed, ok := parsedRules(waf)
+	if !ok {
+		return nil
+	}
+	tags = make(map[string][]int)
+	for i := range parsed.Len() {
+		rule := parsed.Index(i)
+		id := int(rule.FieldByName("ID_").Int())
+		names := rule.FieldByName("Tags_")
+		for j := range names.Len() {
+			tag := names.Index(j).String()
+			tags[tag] = append(tags[tag], id)
+		}
+	}
+	return tags
+}
+
+// parsedRules returns the slice of rules parsed by the WAF, read by reflection. It reports false if the rules can't be
+// found. The caller must recover from panics caused by changes in the Coraza internals.
+func parsedRules(waf coraza.WAF) (reflect.Value, bool) {
+	v := reflect.ValueOf(waf)
+	if v.Kind() == reflect.Pointer {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return reflect.Value{}, false
+	}
+	internal := v.FieldByName("waf")
+	if !internal.IsValid() || internal.Kind() != reflect.Pointer || internal.IsNil() {
+		return reflect.Value{}, false
+	}
+	parsed := internal.Elem().FieldByName("Rules").FieldByName("rules")
+	if parsed.Kind() != reflect.Slice {
+		return reflect.Value{}, false
+	}
+	return parsed, true
+}
@@ -0,0 +1,83 @@
+// Copyright 2024 Sylvain Müller.
+// SPDX-License-Identifier: Apache-2.0
+
+package foxwaf
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+)
+
+// multipartBoundary returns the boundary of a multipart request body, if any.
+func multipartBoundary(req *http.Request) (string, bool) {
+	mt, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mt, "multipart/") {
+		return "", false
+	}
+	boundary := params["boundary"]
+	return boundary, boundary != ""
+}
+
+// limitMultipartParts reads the multipart body and returns a re-encoded copy where each part is truncated to limit
+// bytes, which is the body to inspect, along with the raw bytes consumed from the body, which must be served to the
+// handler followed by any remaining unread bytes. At most max bytes are consumed from the body, unless max is 0: once
+// they are, the parts read so far are returned and the remaining ones are left uninspected. If the body is not a
+// well-formed multipart body, an error is returned along with the raw bytes consumed so far.
+func limitMultipartParts(body io.Reader, boundary string, limit, max int64) (*bytes.Buffer, *bytes.Reader, error) {
+	var raw bytes.Buffer
+	inspected := new(bytes.Buffer)
+	mw := multipart.NewWriter(inspected)
+	if err := mw.SetBoundary(boundary); err != nil {
+		return nil, bytes.NewReader(raw.Bytes()), err
+	}
+
+	var lr *io.LimitedReader
+	if max > 0 {
+		lr = &io.LimitedReader{R: body, N: max}
+		body = lr
+	}
+	// exhausted reports whether the body has been read up to max bytes, in which case the multipart reader fails on
+	// the unexpected end of the body, which is not an error.
+	exhausted := func() bool {
+		return lr != nil && lr.N <= 0
+	}
+
+	mr := multipart.NewReader(io.TeeReader(body, &raw), boundary)
+	for {
+		part, err := mr.NextRawPart()
+		if errors.Is(err, io.EOF) || (err != nil && exhausted()) {
+			break
+		}
+		if err != nil {
+			return nil, bytes.NewReader(raw.Bytes()), err
+		}
+
+		pw, err := mw.CreatePart(part.Header)
+		if err != nil {
+			return nil, bytes.NewReader(raw.Bytes()), err
+		}
+		if _, err := io.Copy(pw, io.LimitReader(part, limit)); err != nil {
+			if exhausted() {
+				break
+			}
+			return nil, bytes.NewReader(raw.Bytes()), err
+		}
+		// The remaining bytes of the part are not inspected, but they are kept in the raw body for the handler.
+		if _, err := io.Copy(io.Discard, part); err != nil {
+			if exhausted() {
+				break
+			}
+			return nil, bytes.NewReader(raw.Bytes()), err
+		}
+	}
+
+	if err := mw.Close(); err != nil {
+		return nil, bytes.NewReader(raw.Bytes()), err
+	}
+	return inspected, bytes.NewReader(raw.Bytes()), nil
+}
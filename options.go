@@ -0,0 +1,861 @@
+// Copyright 2024 Sylvain Müller.
+// SPDX-License-Identifier: Apache-2.0
+
+package foxwaf
+
+import (
+	"fmt"
+	"github.com/corazawaf/coraza/v3/types"
+	"github.com/tigerwill90/fox"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// redactedValue is the placeholder fed to Coraza in place of the value of the headers provided by WithRedactedHeaders.
+const redactedValue = "[REDACTED]"
+
+// rawRequestVariable is the name of the TX variable holding the raw request provided by WithRawRequest.
+const rawRequestVariable = "raw_request"
+
+// Option configures the [WAF] middleware.
+type Option interface {
+	apply(*config)
+}
+
+type optionFunc func(*config)
+
+func (o optionFunc) apply(c *config) {
+	o(c)
+}
+
+type config struct {
+	recorder                   Recorder
+	logger                     *slog.Logger
+	tracer                     Tracer
+	rateLimiter                *rateLimiter
+	ruleStats                  *ruleStats
+	txInit                     func(r *http.Request, tx types.Transaction)
+	ruleExclusions             func(c fox.Context) (ids []int, tags []string)
+	ruleTags                   map[string][]int
+	rejectOverLimit            func(c fox.Context) bool
+	responseBodyLimit          func(c fox.Context) int64
+	logFields                  func(c fox.Context) map[string]string
+	rawRequest                 func(r *http.Request) []byte
+	geoVars                    func(r *http.Request) (country, asn string)
+	clientIPResolver           func(r *http.Request) (string, int)
+	onClean                    func(c fox.Context)
+	headerCleaner              func(h http.Header)
+	skipper                    func(c fox.Context) bool
+	errorHandler               func(c fox.Context, err error)
+	recoverHandler             func(c fox.Context, v any)
+	onInterruption             func(c fox.Context, it *types.Interruption, phase types.RulePhase)
+	veto                       func(c fox.Context, args map[string][]string) *Verdict
+	wsInspector                func(payload []byte) bool
+	wsMaxMessageSize           int
+	finalStatus                func(c fox.Context, status int, interrupted bool)
+	interruptionHandler        InterruptionHandler
+	blockResponse              func(c fox.Context, it *types.Interruption) ([]byte, string)
+	responseRewriter           func(contentType string, body []byte) []byte
+	bodyBypass                 func(h http.Header) bool
+	responseInspectTypes       []string
+	nonBlockingRules           []int
+	wouldBlockStatuses         map[int]int
+	statuslessRules            map[int]struct{}
+	compressTypes              []string
+	stripHeaders               []string
+	redactedHeaders            []string
+	allowedOrigins             []string
+	originDenyStatus           int
+	preflightCORSHeaders       http.Header
+	compressMinSize            int
+	responsePrefix             int
+	spillThreshold             int
+	denyStatus                 int
+	flushChunkSize             int
+	samplingRate               float64
+	maxResponseBuffers         int64
+	responseBuffers            atomic.Int64
+	ipDenylist                 ipList
+	ipAllowlist                ipList
+	ipDenyStatus               int
+	multipartPartLimit         int64
+	maxJSONDepth               int
+	fullBodyMax                int64
+	replayBodyMax              int64
+	maxBodySize                int64
+	maxHeaderValueSize         int
+	maxHeaderBytes             int
+	maxCookies                 int
+	maxCookieBytes             int
+	cookieDenyStatus           int
+	blockContentType           string
+	defaultContentType         string
+	blockBody                  []byte
+	responseErrorBody          []byte
+	responseErrorContentType   string
+	rejectAmbiguousBodyFraming bool
+	stripServerNamePort        bool
+	compress                   bool
+	holdResponse               bool
+	wouldBlockHeaders          bool
+	truncateHeaderValues       bool
+	verdictTrailer             bool
+	serverTiming               bool
+	sortHeaders                bool
+	skipResponseHeaders        bool
+	failClosed                 bool
+	noPool                     bool
+}
+
+func defaultConfig() *config {
+	return &config{
+		stripServerNamePort: true,
+		samplingRate:        1,
+		denyStatus:          http.StatusForbidden,
+	}
+}
+
+// WithRejectAmbiguousBodyFraming rejects with a 400 Bad Request any request carrying both a Content-Length and a
+// Transfer-Encoding, before any inspection takes place. Such requests are a classic request smuggling vector.
+// Note that the net/http server already drops the Content-Length header of chunked requests, so this option is
+// mostly a defense-in-depth measure against requests crafted or forwarded by other components.
+func WithRejectAmbiguousBodyFraming(enable bool) Option {
+	return optionFunc(func(c *config) {
+		c.rejectAmbiguousBodyFraming = enable
+	})
+}
+
+// WithTransactionInit registers a function invoked right after a transaction is created and before any processing
+// takes place. This is the extension point for all per-transaction customization such as removing rules, setting
+// variables or adjusting the engine mode.
+func WithTransactionInit(fn func(r *http.Request, tx types.Transaction)) Option {
+	return optionFunc(func(c *config) {
+		c.txInit = fn
+	})
+}
+
+// WithRuleExclusionResolver registers a function returning the ids and the tags of the rules to remove from the
+// transaction of a request, invoked right after WithTransactionInit. This allows scoping exclusions to routes, e.g.
+// based on the annotations of c.Route(), without editing the ruleset. Tags match like the ctl:ruleRemoveByTag action,
+// and are resolved against the rules parsed by the WAF once, when the middleware is created.
+func WithRuleExclusionResolver(fn func(c fox.Context) (ids []int, tags []string)) Option {
+	return optionFunc(func(c *config) {
+		c.ruleExclusions = fn
+	})
+}
+
+// WithResponseBodyLimit registers a function returning the response body limit of a request, e.g. based on c.Route(),
+// invoked right after WithRuleExclusionResolver. It applies like the ctl:responseBodyLimit action. Coraza sizes the
+// response body buffer after SecResponseBodyLimit, so the limit can only be lowered: set SecResponseBodyLimit to the
+// largest limit needed, and return a lower one for the other routes. A non-positive or larger limit is ignored.
+func WithResponseBodyLimit(fn func(c fox.Context) int64) Option {
+	return optionFunc(func(c *config) {
+		c.responseBodyLimit = fn
+	})
+}
+
+// WithRequestBodyLimitReject registers a function reporting whether a request whose body reaches the Coraza request
+// body limit (SecRequestBodyLimit) is rejected with a 413 Request Entity Too Large, as with SecRequestBodyLimitAction
+// Reject. This allows rejecting over-limit bodies on some routes, e.g. based on c.Route(), while the WAF processes
+// them partially everywhere else. Coraza does not expose a per-transaction setter for the limit action, so the
+// opposite, processing bodies partially on some routes of a WAF configured with Reject, is not possible.
+func WithRequestBodyLimitReject(fn func(c fox.Context) bool) Option {
+	return optionFunc(func(c *config) {
+		c.rejectOverLimit = fn
+	})
+}
+
+// WithBlockBody sets a static body sent along with the status code whenever a request or a response is interrupted,
+// instead of an empty response. Some clients hang or show confusing errors on an empty response. The Content-Type and
+// Content-Length headers are set accordingly.
+func WithBlockBody(body []byte, contentType string) Option {
+	return optionFunc(func(c *config) {
+		c.blockBody = body
+		c.blockContentType = contentType
+	})
+}
+
+// InterruptionHandler sets the headers and returns the body sent along with the status code whenever a request or a
+// response is interrupted. The response headers have been cleaned beforehand, and the Content-Length header is set
+// from the returned body.
+type InterruptionHandler func(h http.Header, status int, it *types.Interruption) []byte
+
+// WithInterruptionHandler registers an [InterruptionHandler] building the response sent on interruption. It takes
+// precedence over WithBlockBody.
+func WithInterruptionHandler(fn InterruptionHandler) Option {
+	return optionFunc(func(c *config) {
+		c.interruptionHandler = fn
+	})
+}
+
+// WithBlockResponse registers a function returning the body, along with its content type, sent with the status code
+// whenever a request or a response is interrupted, e.g. a branded JSON or HTML error page. The Content-Type and
+// Content-Length headers are set accordingly. Unlike WithInterruptionHandler, it has access to the request context,
+// which is the one passed to the next handler when the response is interrupted. It takes precedence over both
+// WithInterruptionHandler and WithBlockBody.
+func WithBlockResponse(fn func(c fox.Context, it *types.Interruption) ([]byte, string)) Option {
+	return optionFunc(func(c *config) {
+		c.blockResponse = fn
+	})
+}
+
+// blockBodyFor sets the headers matching the body sent on interruption and returns it. Redirect interruptions are
+// sent without body, along with their Location header.
+func (c *config) blockBodyFor(fc fox.Context, h http.Header, status int, it *types.Interruption) []byte {
+	// A redirect carries no body.
+	if writeRedirectHeaders(h, it) {
+		return nil
+	}
+	if c.blockResponse != nil {
+		body, contentType := c.blockResponse(fc, it)
+		if len(body) > 0 {
+			h.Set("Content-Type", contentType)
+		}
+		h.Set("Content-Length", strconv.Itoa(len(body)))
+		return body
+	}
+	if c.interruptionHandler != nil {
+		body := c.interruptionHandler(h, status, it)
+		h.Set("Content-Length", strconv.Itoa(len(body)))
+		return body
+	}
+	c.setBlockBodyHeaders(h)
+	return c.blockBody
+}
+
+// setBlockBodyHeaders sets the Content-Type and Content-Length headers matching the configured block body.
+func (c *config) setBlockBodyHeaders(h http.Header) {
+	if len(c.blockBody) == 0 {
+		h.Set("Content-Length", "0")
+		return
+	}
+	h.Set("Content-Type", c.blockContentType)
+	h.Set("Content-Length", strconv.Itoa(len(c.blockBody)))
+}
+
+// WithPreflightCORSHeaders sets headers (e.g. Access-Control-Allow-Origin) added to the response whenever an OPTIONS
+// request is blocked. Without them, browsers report a blocked CORS preflight as an opaque CORS error rather than
+// surfacing the block status. The headers are applied after the response headers are cleaned.
+func WithPreflightCORSHeaders(h http.Header) Option {
+	return optionFunc(func(c *config) {
+		c.preflightCORSHeaders = h.Clone()
+	})
+}
+
+// setPreflightCORSHeaders sets the configured CORS headers on the response of a blocked preflight request.
+func (c *config) setPreflightCORSHeaders(h http.Header) {
+	for k, vv := range c.preflightCORSHeaders {
+		h.Del(k)
+		for _, v := range vv {
+			h.Add(k, v)
+		}
+	}
+}
+
+// WithStripServerNamePort controls whether the port of the Host header is stripped when populating the SERVER_NAME
+// variable. The raw Host header is always added as a request header. By default, the port is stripped for CRS
+// compatibility.
+func WithStripServerNamePort(enable bool) Option {
+	return optionFunc(func(c *config) {
+		c.stripServerNamePort = enable
+	})
+}
+
+// WithMetrics registers a [Recorder] used to report metrics about the WAF processing.
+func WithMetrics(recorder Recorder) Option {
+	return optionFunc(func(c *config) {
+		c.recorder = recorder
+	})
+}
+
+// WithLoggingFields registers a function returning fields (e.g. resolved client IP, route pattern or request ID) to
+// enrich the transaction with, right before phase 5 rules run and the audit log is written. Each field is set as a
+// TX variable, so it can be matched by logging rules and expanded in their messages (e.g. %{tx.request_id}).
+func WithLoggingFields(fn func(c fox.Context) map[string]string) Option {
+	return optionFunc(func(c *config) {
+		c.logFields = fn
+	})
+}
+
+// WithResponseBodyInspectTypes restricts response body inspection to the given content types (e.g. "application/json",
+// "text/html"). Responses of any other type are streamed to the client without being buffered. The listed types must
+// also be part of Coraza's SecResponseBodyMimeType to be inspected, as this option can only narrow it.
+func WithResponseBodyInspectTypes(contentTypes ...string) Option {
+	return optionFunc(func(c *config) {
+		for _, typ := range contentTypes {
+			c.responseInspectTypes = append(c.responseInspectTypes, mediaType(typ))
+		}
+	})
+}
+
+// WithResponseCompression enables gzip compression of the responses buffered for inspection, once the inspection has
+// passed. Since the whole body is already buffered, its size is known and compressing it is cheap. Only responses of
+// at least minSize bytes whose content type is one of the given types (or any type if none is provided) are
+// compressed, provided that the client accepts gzip and the handler did not already set a Content-Encoding.
+func WithResponseCompression(minSize int, contentTypes ...string) Option {
+	return optionFunc(func(c *config) {
+		c.compress = true
+		c.compressMinSize = minSize
+		for _, typ := range contentTypes {
+			c.compressTypes = append(c.compressTypes, mediaType(typ))
+		}
+	})
+}
+
+// WithMultipartPartLimit limits the number of bytes of each part of a multipart request body fed to Coraza, so that a
+// single huge part (e.g. a file upload) does not exhaust the inspection budget while the subsequent parts go
+// uninspected. The handler still receives the original body. Note that the multipart body is read and kept in memory
+// before being inspected, up to the Coraza request body limit (or WithMaxRequestBodySize if lower): the parts past it
+// stream to the handler uninspected.
+func WithMultipartPartLimit(n int64) Option {
+	return optionFunc(func(c *config) {
+		c.multipartPartLimit = n
+	})
+}
+
+// WithHoldResponseUntilInspected holds the response body in memory until the response body phase completes, even when
+// the body is not inspected by Coraza (body access disabled or content type not processable). This ensures that any
+// applicable response rule can still block the response before the client sees any byte, at the cost of latency
+// (no byte is sent before the handler returns) and memory (the whole response is buffered). This option should be
+// used for deployments favoring security over latency, and is incompatible with streaming responses.
+func WithHoldResponseUntilInspected(enable bool) Option {
+	return optionFunc(func(c *config) {
+		c.holdResponse = enable
+	})
+}
+
+// WithRawRequest registers a function returning the raw request (request line and headers) as it arrived on the
+// wire, for protocol-anomaly rules. Go does not expose the raw request, so it must be captured elsewhere, e.g. by a
+// custom listener. The returned bytes are set as the TX:raw_request variable before request headers rules run, so
+// rules can match on it. A nil value is ignored.
+func WithRawRequest(fn func(r *http.Request) []byte) Option {
+	return optionFunc(func(c *config) {
+		c.rawRequest = fn
+	})
+}
+
+// WithWouldBlockHeaders reports the would-be verdict of a WAF running in monitor mode (SecRuleEngine DetectionOnly)
+// to downstream infrastructure. When a matched rule carries a deny, drop or redirect action, the "X-WAF-Would-Block"
+// and "X-WAF-Would-Status" response headers are set before the response status is sent, while the response itself is
+// left untouched. Since Coraza does not record disruptive actions in DetectionOnly mode, they are looked up in the
+// parsed rules, read once when the middleware is created, where a block action resolves to the disruptive action of
+// the matching SecDefaultAction.
+func WithWouldBlockHeaders(enable bool) Option {
+	return optionFunc(func(c *config) {
+		c.wouldBlockHeaders = enable
+	})
+}
+
+// WithMaxHeaderValueSize limits the size of each request header value to n bytes, to protect the WAF and the
+// application from header-bomb attacks. Requests with a larger header value are rejected with a 431 Request Header
+// Fields Too Large, unless truncate is true, in which case the value is truncated before being fed to Coraza (the
+// handler still sees the original value).
+func WithMaxHeaderValueSize(n int, truncate bool) Option {
+	return optionFunc(func(c *config) {
+		c.maxHeaderValueSize = n
+		c.truncateHeaderValues = truncate
+	})
+}
+
+// WithOnClean registers a function invoked when a request passes the request phases without interruption, right before
+// calling the next handler. It receives the context passed to the next handler, so it can be used to add headers or
+// record metrics for allowed requests specifically.
+func WithOnClean(fn func(c fox.Context)) Option {
+	return optionFunc(func(c *config) {
+		c.onClean = fn
+	})
+}
+
+// WithOnInterruption registers a function invoked whenever a request or a response is interrupted, e.g. to emit a
+// metric, record a security event or add a response header. It runs right before the status code is sent, once the
+// response headers have been cleaned, so it can still mutate them. The phase is the phase at which the transaction
+// was interrupted: request headers or request body when processing the request, response headers or response body
+// when processing the response. A request vetoed by WithRequestVeto is reported at the request body phase. For
+// response phases, the context is the one passed to the next handler.
+func WithOnInterruption(fn func(c fox.Context, it *types.Interruption, phase types.RulePhase)) Option {
+	return optionFunc(func(c *config) {
+		c.onInterruption = fn
+	})
+}
+
+// notifyInterruption reports an interruption to the recorder and to the interruption callback, if any.
+func (c *config) notifyInterruption(fc fox.Context, it *types.Interruption, phase types.RulePhase) {
+	if c.recorder != nil {
+		c.recorder.ObserveInterruption(phase, it.RuleID, it.Action)
+	}
+	if c.onInterruption != nil {
+		c.onInterruption(fc, it, phase)
+	}
+}
+
+// WithVerdictTrailer declares an "X-WAF-Verdict" response trailer carrying the final verdict of the transaction
+// ("pass" or "interrupted"), set once the response body phase completes. This lets clients reading trailers know
+// whether a streamed response passed inspection. A response body whose inspection is skipped has already been sent
+// when the response body rules run, so an interruption at that point is not enforced and reported as "detected"
+// instead. Note that trailers are only sent with chunked responses, so they are dropped when the response has a
+// Content-Length.
+func WithVerdictTrailer(enable bool) Option {
+	return optionFunc(func(c *config) {
+		c.verdictTrailer = enable
+	})
+}
+
+// WithNonBlockingRules demotes interruptions caused by the given rule IDs to log-only: the interruption is logged
+// but the request or response proceeds as if it was not interrupted. This is useful to tune noisy rules without
+// editing or removing them. Note that Coraza stops evaluating rules once a transaction is interrupted, so the
+// remaining of the transaction is no longer inspected after a demoted interruption.
+func WithNonBlockingRules(ids ...int) Option {
+	return optionFunc(func(c *config) {
+		c.nonBlockingRules = append(c.nonBlockingRules, ids...)
+	})
+}
+
+// WithFailClosed controls the failure policy applied when the Coraza WAF fails to create a transaction. By default,
+// the middleware fails open and calls the next handler without inspection. When enabled, the request is rejected with
+// a 503 Service Unavailable instead.
+func WithFailClosed(enable bool) Option {
+	return optionFunc(func(c *config) {
+		c.failClosed = enable
+	})
+}
+
+// WithWebSocketInspector registers a function inspecting the payload of each WebSocket data message sent by the client,
+// once the connection has been hijacked by the handler to complete a WebSocket handshake. Fragmented messages are
+// reassembled before being inspected, and the frames of a message are only readable from the connection once the
+// message has been approved, which requires buffering up to maxMessageSize bytes per connection. Returning false
+// closes the connection, and the pending read fails with [ErrWebSocketViolation]. Frames and messages larger than
+// maxMessageSize bytes (1 MiB if not positive) close the connection as well, and the pending read fails with
+// [ErrWebSocketMessageTooLarge]. This is separate from the HTTP processing, Coraza rules don't apply to the messages.
+func WithWebSocketInspector(maxMessageSize int, fn func(payload []byte) bool) Option {
+	return optionFunc(func(c *config) {
+		c.wsInspector = fn
+		c.wsMaxMessageSize = maxMessageSize
+		if maxMessageSize <= 0 {
+			c.wsMaxMessageSize = defaultWebSocketMessageSize
+		}
+	})
+}
+
+// WithFinalStatus registers a function invoked exactly once per transaction with the final status code sent to the
+// client, once it has been flushed. This covers requests blocked during the request phases, responses blocked during
+// the response phases and normal responses, which makes it suitable for consistent access logging. Requests bypassing
+// the inspection (skipped, unsampled, allowlisted or already inspected by an upstream WAF) are reported as well, except
+// by an instance applied more than once in the same handler chain, which reports them once. The interrupted flag
+// reports whether the transaction has been interrupted by the WAF.
+func WithFinalStatus(fn func(c fox.Context, status int, interrupted bool)) Option {
+	return optionFunc(func(c *config) {
+		c.finalStatus = fn
+	})
+}
+
+// WithStripResponseHeaders removes the given headers (e.g. "Server", "X-Powered-By", "X-AspNet-Version") from the
+// response right before its status code is sent to the client, to avoid leaking information about the stack. This
+// applies to every response, including the ones not inspected and the ones written by the middleware on interruption.
+// The headers are still visible to the response headers rules.
+func WithStripResponseHeaders(names ...string) Option {
+	return optionFunc(func(c *config) {
+		for _, name := range names {
+			c.stripHeaders = append(c.stripHeaders, http.CanonicalHeaderKey(name))
+		}
+	})
+}
+
+// WithFullRequestBuffering buffers the whole request body in memory, up to limit bytes, before inspecting it. Coraza
+// still inspects the body up to its own limit, but the handler is served with a fresh reader over the entire body,
+// which is also available with [FullRequestBody]. Requests with a larger body are rejected with a 413 Request Entity
+// Too Large. This trades memory for convenience, so limit should be kept reasonably small. It only applies when the
+// request body is accessible to Coraza.
+func WithFullRequestBuffering(limit int64) Option {
+	return optionFunc(func(c *config) {
+		c.fullBodyMax = limit
+	})
+}
+
+// bodyBufferLimit returns the size up to which request bodies are buffered in memory, and whether larger bodies are
+// rejected. WithFullRequestBuffering takes precedence over WithReplayableBody.
+func (c *config) bodyBufferLimit() (int64, bool) {
+	if c.fullBodyMax > 0 {
+		return c.fullBodyMax, true
+	}
+	return c.replayBodyMax, false
+}
+
+// WithMaxConcurrentResponseBuffers limits the number of responses buffered concurrently, either for inspection or
+// because of WithHoldResponseUntilInspected, since each large buffered response holds memory. Once the limit is
+// reached, new responses are streamed to the client without their body being inspected, rather than being blocked.
+func WithMaxConcurrentResponseBuffers(n int) Option {
+	return optionFunc(func(c *config) {
+		c.maxResponseBuffers = int64(n)
+	})
+}
+
+// WithRedactedHeaders feeds a "[REDACTED]" placeholder to Coraza instead of the value of the given request headers
+// (e.g. "Authorization", "Cookie"), so that credentials are neither stored in the transaction buffers nor written to
+// the audit log. The headers are still present, so rules checking their existence keep working, and the handler
+// still sees the real values.
+func WithRedactedHeaders(names ...string) Option {
+	return optionFunc(func(c *config) {
+		for _, name := range names {
+			c.redactedHeaders = append(c.redactedHeaders, http.CanonicalHeaderKey(name))
+		}
+	})
+}
+
+// WithRequestSampling inspects only a fraction of the requests, given by rate between 0 and 1, for capacity-limited
+// environments. The other requests are passed through to the next handler untouched, so blocking only applies to
+// sampled requests. Unsampled requests are reported to the [Recorder], if any. By default, all requests are inspected.
+func WithRequestSampling(rate float64) Option {
+	return optionFunc(func(c *config) {
+		c.samplingRate = rate
+	})
+}
+
+// WithGeoVars registers a function returning the country code and the ASN of the client, as resolved by an earlier
+// layer. They are set as the GEO:COUNTRY_CODE and GEO:ASN variables before any rule runs, so geo rules can match on
+// them (e.g. SecRule GEO:COUNTRY_CODE "@pm XX YY" "id:100,phase:1,deny"). Empty values are ignored.
+func WithGeoVars(fn func(r *http.Request) (country, asn string)) Option {
+	return optionFunc(func(c *config) {
+		c.geoVars = fn
+	})
+}
+
+// WithResponseHeaderInspection controls whether the response headers are fed to Coraza. When disabled, only the
+// Content-Type header is fed, since it decides whether the response body is processable, so rules matching on the
+// other response headers don't fire while the response body is still inspected. Response headers rules still run,
+// as Coraza requires them before processing the response body. By default, response headers are inspected.
+func WithResponseHeaderInspection(enable bool) Option {
+	return optionFunc(func(c *config) {
+		c.skipResponseHeaders = !enable
+	})
+}
+
+// WithMaxRequestHeaderBytes limits the aggregate size of the request header block to n bytes, complementing
+// WithMaxHeaderValueSize with an overall cap. The size is estimated from the parsed headers, each field counted as
+// "Key: Value\r\n". Requests with a larger header block are rejected with a 431 Request Header Fields Too Large before
+// any inspection. Note that the server MaxHeaderBytes still applies first.
+func WithMaxRequestHeaderBytes(n int) Option {
+	return optionFunc(func(c *config) {
+		c.maxHeaderBytes = n
+	})
+}
+
+// WithResponseRewriter registers a function rewriting the response body (e.g. to canonicalize the output) before it
+// is inspected. The rewritten body is both inspected by Coraza and sent to the client. It only applies to responses
+// buffered for inspection, and the whole body is held in memory until the response body phase. Bodies exceeding the
+// spill threshold (see WithResponseBufferSpillToStream) are sent unmodified and uninspected. Without spill threshold,
+// bodies exceeding the Coraza response body limit are sent unmodified, once the Coraza limit action has been applied
+// to the original body (Reject blocks the response, ProcessPartial inspects the first bytes).
+func WithResponseRewriter(fn func(contentType string, body []byte) []byte) Option {
+	return optionFunc(func(c *config) {
+		c.responseRewriter = fn
+	})
+}
+
+// WithClientIPResolver registers a function resolving the client IP address and port fed to Coraza, e.g. from the
+// X-Forwarded-For or X-Real-IP headers, or from the PROXY protocol, when the application runs behind a reverse proxy
+// or a load balancer. The resolved address is also the one returned by [ClientIP]. By default, the client address is
+// parsed from the request RemoteAddr.
+func WithClientIPResolver(fn func(r *http.Request) (string, int)) Option {
+	return optionFunc(func(c *config) {
+		c.clientIPResolver = fn
+	})
+}
+
+// WithDefaultRequestContentType sets the content type fed to Coraza for requests carrying a body without a
+// Content-Type header (e.g. "application/octet-stream" or "text/plain"), so that attacks omitting it to evade
+// content-type-gated rules are still inspected. The handler still sees the original request headers.
+func WithDefaultRequestContentType(contentType string) Option {
+	return optionFunc(func(c *config) {
+		c.defaultContentType = contentType
+	})
+}
+
+// WithTrustedProxies resolves the client IP fed to Coraza from the X-Forwarded-For header, provided that the immediate
+// peer is part of the given trusted prefixes. The chain is walked right-to-left and the first hop which is not a
+// trusted proxy is the client. If the peer is not trusted, or if the header is missing or malformed, the client
+// address is parsed from the request RemoteAddr. This is a built-in resolver for WithClientIPResolver, so only the
+// last one applies.
+func WithTrustedProxies(prefixes ...netip.Prefix) Option {
+	return optionFunc(func(c *config) {
+		c.clientIPResolver = trustedProxiesResolver(prefixes)
+	})
+}
+
+// Verdict is the decision of a request veto registered with WithRequestVeto.
+type Verdict struct {
+	// Status is the status code sent to the client. A zero value defaults to the deny status, 403 Forbidden unless
+	// configured otherwise with WithDefaultDenyStatus.
+	Status int
+}
+
+// WithRequestVeto registers a function taking an application-level allow or deny decision, based on the arguments
+// (query and body) parsed by Coraza, once the request phases pass without interruption. Returning a non-nil [Verdict]
+// blocks the request with the verdict status, exactly like an interruption. Returning nil lets the request through.
+func WithRequestVeto(fn func(c fox.Context, args map[string][]string) *Verdict) Option {
+	return optionFunc(func(c *config) {
+		c.veto = fn
+	})
+}
+
+// WithChunkedFlush sends the responses held or buffered for inspection in chunks of size bytes, flushed one by one,
+// instead of a single write once the inspection has passed. This reduces the time to first byte of large inspected
+// responses. Note that the response is only sent with the chunked transfer encoding if the handler did not set a
+// Content-Length.
+func WithChunkedFlush(size int) Option {
+	return optionFunc(func(c *config) {
+		c.flushChunkSize = size
+	})
+}
+
+// WithDefaultDenyStatus sets the status code sent when a request or a response is denied by a rule which does not
+// specify one, e.g. 406 to distinguish WAF blocks from application-level forbidden responses. The code must be in the
+// 4xx or 5xx range, otherwise this option panics. By default, 403 Forbidden is sent.
+func WithDefaultDenyStatus(code int) Option {
+	if code < 400 || code > 599 {
+		panic(fmt.Sprintf("foxwaf: invalid default deny status %d, must be in the 4xx or 5xx range", code))
+	}
+	return optionFunc(func(c *config) {
+		c.denyStatus = code
+	})
+}
+
+// WithLogger routes the failures to process a transaction through the given logger rather than the Coraza debug
+// logger, with structured fields (transaction ID, client IP, method, path and error). Failures caused by the client,
+// such as a malformed chunked body, are logged at warn level, and other failures at error level.
+func WithLogger(logger *slog.Logger) Option {
+	return optionFunc(func(c *config) {
+		c.logger = logger
+	})
+}
+
+// WithoutInterceptorPool allocates a fresh response interceptor and request body reader for each request instead of
+// reusing pooled ones. This is only meant for debugging, e.g. to rule out state bleeding between requests, as pooling is
+// better for performance.
+func WithoutInterceptorPool() Option {
+	return optionFunc(func(c *config) {
+		c.noPool = true
+	})
+}
+
+// WithTracer registers a [Tracer] starting a span around the WAF processing of each inspected request, from the
+// request phases to the response phases, as a child of the span carried by the request context. The span carries the
+// transaction ID, and interruptions are recorded as span events along with the rule ID and action attributes.
+func WithTracer(tracer Tracer) Option {
+	return optionFunc(func(c *config) {
+		c.tracer = tracer
+	})
+}
+
+// WithAllowedOrigins blocks with the given status the state-changing requests (POST, PUT, PATCH and DELETE) whose
+// Origin, or the origin of their Referer if missing, is not one of the given origins (e.g. "https://example.com"), as
+// a WAF-level CSRF backstop. Requests carrying neither header are allowed. Blocked requests are denied once the request
+// headers rules have passed. If status is 0, the default deny status is used (see WithDefaultDenyStatus).
+func WithAllowedOrigins(status int, origins ...string) Option {
+	return optionFunc(func(c *config) {
+		c.originDenyStatus = status
+		for _, origin := range origins {
+			c.allowedOrigins = append(c.allowedOrigins, strings.ToLower(strings.TrimSuffix(origin, "/")))
+		}
+	})
+}
+
+// WithReplayableBody buffers in memory request bodies of up to limit bytes, so that they can be replayed, e.g. by a
+// retry layer, after being rewound with [ResetBody]. Unlike WithFullRequestBuffering, larger bodies are not rejected:
+// they stream to the handler as usual and can't be replayed. Since a fully buffered body is replayable as well,
+// WithFullRequestBuffering takes precedence when both are set. It only applies when the request body is accessible to
+// Coraza.
+func WithReplayableBody(limit int64) Option {
+	return optionFunc(func(c *config) {
+		c.replayBodyMax = limit
+	})
+}
+
+// WithResponseBodyBypass registers a function deciding, from the response headers, whether the response body must be
+// written straight to the client instead of being buffered for inspection (or held with
+// WithHoldResponseUntilInspected). This is meant for streaming responses such as "text/event-stream". The decision is
+// taken once the response headers are known, and the response headers rules still run.
+func WithResponseBodyBypass(fn func(h http.Header) bool) Option {
+	return optionFunc(func(c *config) {
+		c.bodyBypass = fn
+	})
+}
+
+// WithRateLimit rejects with a 429 Too Many Requests the requests of any client exceeding perIP requests per window,
+// before any rule processing, and even when the rule engine is off. Clients are identified by their resolved IP (see
+// WithClientIPResolver), and limited with an in-memory token bucket allowing bursts of up to perIP requests. This is a
+// lightweight front-line control, not a replacement for a distributed rate limiter. Both perIP and window must be
+// positive, otherwise this option panics.
+func WithRateLimit(perIP int, window time.Duration) Option {
+	if perIP <= 0 || window <= 0 {
+		panic(fmt.Sprintf("foxwaf: invalid rate limit of %d requests per %s, both must be positive", perIP, window))
+	}
+	return optionFunc(func(c *config) {
+		c.rateLimiter = newRateLimiter(perIP, window)
+	})
+}
+
+// WithHeaderCleaner registers a function cleaning the response headers set by the handler when a response is
+// interrupted, replacing the default behavior of removing them all. This allows e.g. keeping security headers on a
+// blocked response while dropping the content headers. The headers of the block response (see WithBlockBody) are set
+// afterward.
+func WithHeaderCleaner(fn func(h http.Header)) Option {
+	return optionFunc(func(c *config) {
+		c.headerCleaner = fn
+	})
+}
+
+// WithSkipper registers a function reporting whether a request must bypass the WAF entirely, e.g. for health check or
+// metrics endpoints. It is called before anything else, so skipped requests are neither inspected nor reported to
+// the [Recorder].
+func WithSkipper(fn func(c fox.Context) bool) Option {
+	return optionFunc(func(c *config) {
+		c.skipper = fn
+	})
+}
+
+// WithMaxJSONDepth rejects with a 400 Bad Request any JSON request body nesting objects and arrays deeper than n,
+// before it reaches the Coraza JSON body processor. The depth is scanned as the body is read, which protects against
+// algorithmic complexity attacks on deeply nested payloads. This only applies to inspected request bodies with an
+// "application/json" or "+json" content type.
+func WithMaxJSONDepth(n int) Option {
+	return optionFunc(func(c *config) {
+		c.maxJSONDepth = n
+	})
+}
+
+// WithServerTimingHeader adds a Server-Timing header reporting the time spent by the WAF processing the request phases
+// (waf-req) and, when the response is held until its body has been inspected, the response body phase (waf-resp).
+// This surfaces the WAF cost in browser developer tools, and is intended for non-production environments.
+func WithServerTimingHeader(enable bool) Option {
+	return optionFunc(func(c *config) {
+		c.serverTiming = enable
+	})
+}
+
+// WithMaxRequestBodySize caps the size of request bodies at n bytes, independently of the Coraza request body limit,
+// which only controls how much of the body is inspected (e.g. with SecRequestBodyLimitAction ProcessPartial). Requests
+// declaring a larger Content-Length, or whose inspected body exceeds the cap, are rejected with a 413 Request Entity
+// Too Large. Past the inspected bytes, the handler gets a *http.MaxBytesError once the cap is exceeded, as with
+// http.MaxBytesReader.
+func WithMaxRequestBodySize(n int64) Option {
+	return optionFunc(func(c *config) {
+		c.maxBodySize = n
+	})
+}
+
+// WithErrorHandler registers a function invoked when the WAF fails to process a request or a response, after the error
+// has been logged. On request processing failures, the handler is not called and the error handler may write the
+// response. If it doesn't, or when no error handler is set, a 500 Internal Server Error is sent (or a 400 Bad Request
+// for malformed chunked bodies when no error handler is set), so the client always gets a definitive response. On
+// response processing failures, the status code has already been sent to the client, so the error handler can only
+// observe the failure.
+func WithErrorHandler(fn func(c fox.Context, err error)) Option {
+	return optionFunc(func(c *config) {
+		c.errorHandler = fn
+	})
+}
+
+// WithIPDenylist blocks with the given status the requests whose client IP (see WithClientIPResolver) belongs to any
+// of the given ranges, before a transaction is even created. This is cheaper than an equivalent Coraza rule, and the
+// list can be replaced at runtime with [WAF.SetIPDenylist]. If status is 0, the default deny status is used. Denied
+// requests go through the interruption callbacks and the tracer as any other interruption, at the request headers
+// phase.
+func WithIPDenylist(cidrs []netip.Prefix, status int) Option {
+	return optionFunc(func(c *config) {
+		c.ipDenylist.store(cidrs)
+		c.ipDenyStatus = status
+	})
+}
+
+// WithIPAllowlist lets the requests whose client IP (see WithClientIPResolver) belongs to any of the given ranges
+// bypass the WAF entirely, before a transaction is even created, e.g. for health checkers or internal scanners. The
+// list can be replaced at runtime with [WAF.SetIPAllowlist].
+//
+// Security: allowlisted requests are neither inspected nor logged, so any attack coming from, or relayed through, an
+// allowlisted address goes unnoticed. Keep the ranges as narrow as possible, and make sure the client IP can't be
+// spoofed, e.g. by only trusting forwarding headers set by your own proxies (see WithTrustedProxies). The denylist
+// takes precedence over the allowlist.
+func WithIPAllowlist(cidrs []netip.Prefix) Option {
+	return optionFunc(func(c *config) {
+		c.ipAllowlist.store(cidrs)
+	})
+}
+
+// WithMaxCookies rejects with the given status any request carrying more than count cookies, or Cookie headers totaling
+// more than totalSize bytes, before any inspection. This protects both Coraza cookie parsing and the application
+// against cookie bombs. A zero count or totalSize disables the corresponding limit. If status is 0, the default deny
+// status is used (see WithDefaultDenyStatus).
+func WithMaxCookies(count int, totalSize int, status int) Option {
+	return optionFunc(func(c *config) {
+		c.maxCookies = count
+		c.maxCookieBytes = totalSize
+		c.cookieDenyStatus = status
+	})
+}
+
+// WithResponsePrefixInspection only buffers and inspects the first n bytes of inspected response bodies, e.g. to detect
+// an error banner leaked at the top of large responses. Once n bytes have been buffered, the response body rules run on
+// them, and the rest of the body streams through uninspected. This bounds the buffering cost of large responses while
+// keeping partial protection. It has no effect with WithResponseRewriter, which requires the whole body, and the
+// response is not compressed (see WithResponseCompression) once it streams through.
+func WithResponsePrefixInspection(n int) Option {
+	return optionFunc(func(c *config) {
+		c.responsePrefix = n
+	})
+}
+
+// WithSortedRequestHeaders feeds the request headers to Coraza sorted by name, instead of in random order, so that
+// rules sensitive to the header order and audit logs are deterministic. The order in which headers appeared on the
+// wire is not preserved by net/http, so it can't be used instead.
+func WithSortedRequestHeaders(enable bool) Option {
+	return optionFunc(func(c *config) {
+		c.sortHeaders = enable
+	})
+}
+
+// WithRecover recovers from panics in the downstream handler, so the response and the transaction are still finalized
+// cleanly. The function is called with the recovered value, then a 500 Internal Server Error is sent unless the
+// handler already wrote the response, in which case it is completed with what has been written so far. Panics with
+// http.ErrAbortHandler are not recovered. Without this option, panics propagate.
+func WithRecover(fn func(c fox.Context, v any)) Option {
+	return optionFunc(func(c *config) {
+		c.recoverHandler = fn
+	})
+}
+
+// WithRuleStats enables counting how many times each rule matched over the lifetime of the [WAF], which are reported
+// by [WAF.RuleStats]. Counting takes a lock once per transaction matching any rule.
+func WithRuleStats(enable bool) Option {
+	return optionFunc(func(c *config) {
+		if enable {
+			c.ruleStats = newRuleStats()
+			return
+		}
+		c.ruleStats = nil
+	})
+}
+
+// WithResponseBufferSpillToStream abandons the inspection of response bodies exceeding threshold bytes, rather than
+// buffering an unexpectedly large body: the bytes buffered so far are sent uninspected, and the rest of the body
+// streams through. The incomplete inspection is reported by ResponseInspected. Response bodies held for a rewrite
+// (see WithResponseRewriter) are sent unmodified past the threshold.
+func WithResponseBufferSpillToStream(threshold int) Option {
+	return optionFunc(func(c *config) {
+		c.spillThreshold = threshold
+	})
+}
+
+// WithResponseErrorBody sets the body, along with its content type, sent with the 500 Internal Server Error replied
+// when the response can't be processed (e.g. Coraza fails to process the response body), instead of an empty response.
+// The headers set by the handler are removed beforehand (see WithHeaderCleaner).
+func WithResponseErrorBody(body []byte, contentType string) Option {
+	return optionFunc(func(c *config) {
+		c.responseErrorBody = body
+		c.responseErrorContentType = contentType
+	})
+}
@@ -0,0 +1,36 @@
+// Copyright 2024 Sylvain Müller.
+// SPDX-License-Identifier: Apache-2.0
+
+package foxwaf
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// isAllowedOrigin reports whether the request is allowed by the origin allowlist. Only state-changing requests are
+// checked, against their Origin header or, if missing, the origin of their Referer header. Requests carrying neither
+// are allowed, as browsers always send an Origin with cross-origin state-changing requests.
+func isAllowedOrigin(req *http.Request, allowed []string) bool {
+	switch req.Method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+	default:
+		return true
+	}
+
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		referer := req.Header.Get("Referer")
+		if referer == "" {
+			return true
+		}
+		u, err := url.Parse(referer)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return false
+		}
+		origin = u.Scheme + "://" + u.Host
+	}
+	return slices.Contains(allowed, strings.ToLower(origin))
+}
@@ -0,0 +1,41 @@
+// Copyright 2024 Sylvain Müller.
+// SPDX-License-Identifier: Apache-2.0
+
+package foxwaf
+
+import (
+	"encoding/json"
+	"github.com/corazawaf/coraza/v3/types"
+	"net/http"
+)
+
+// problemDetails is an RFC 7807 problem details object, extended with the ID of the rule which caused the interruption.
+type problemDetails struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	RuleID int    `json:"waf_rule_id,omitempty"`
+}
+
+// ProblemDetailsInterruptionHandler returns an [InterruptionHandler] responding with an RFC 7807 problem details body
+// ("application/problem+json"), carrying the given type URI, the status text as title, the status code and the ID of
+// the rule which caused the interruption as "waf_rule_id" extension member. An empty type URI defaults to
+// "about:blank".
+func ProblemDetailsInterruptionHandler(typeURI string) InterruptionHandler {
+	if typeURI == "" {
+		typeURI = "about:blank"
+	}
+	return func(h http.Header, status int, it *types.Interruption) []byte {
+		body, err := json.Marshal(problemDetails{
+			Type:   typeURI,
+			Title:  http.StatusText(status),
+			Status: status,
+			RuleID: it.RuleID,
+		})
+		if err != nil {
+			return nil
+		}
+		h.Set("Content-Type", "application/problem+json")
+		return body
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2024 Sylvain Müller.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package prometheus provides a [foxwaf.Recorder] reporting the WAF metrics to Prometheus. It is a separate module, so
+// that the core package does not depend on the Prometheus client.
+package prometheus
+
+import (
+	"github.com/corazawaf/coraza/v3/types"
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/tigerwill90/foxwaf"
+	"strconv"
+	"time"
+)
+
+var _ foxwaf.Recorder = (*Recorder)(nil)
+
+// Recorder is a [foxwaf.Recorder] reporting the WAF metrics to Prometheus. It is safe for concurrent use.
+type Recorder struct {
+	requestBodyBytes   *prom.CounterVec
+	responseBodyBytes  *prom.CounterVec
+	handlerDuration    prom.Histogram
+	overheadDuration   prom.Histogram
+	processingDuration *prom.HistogramVec
+	matchedRules       prom.Histogram
+	unsampledRequests  prom.Counter
+	interruptions      *prom.CounterVec
+}
+
+// NewRecorder creates a new [Recorder] and registers its metrics with reg. It returns an error if any of the metrics
+// can't be registered, e.g. if they are already registered.
+func NewRecorder(reg prom.Registerer) (*Recorder, error) {
+	r := &Recorder{
+		requestBodyBytes: prom.NewCounterVec(prom.CounterOpts{
+			Name: "foxwaf_request_body_bytes_total",
+			Help: "Number of request body bytes, either inspected or passed through uninspected.",
+		}, []string{"inspected"}),
+		responseBodyBytes: prom.NewCounterVec(prom.CounterOpts{
+			Name: "foxwaf_response_body_bytes_total",
+			Help: "Number of response body bytes, either inspected or passed through uninspected.",
+		}, []string{"inspected"}),
+		handlerDuration: prom.NewHistogram(prom.HistogramOpts{
+			Name: "foxwaf_handler_duration_seconds",
+			Help: "Time spent in the downstream handler.",
+		}),
+		overheadDuration: prom.NewHistogram(prom.HistogramOpts{
+			Name: "foxwaf_overhead_duration_seconds",
+			Help: "Time spent in the middleware, excluding the downstream handler.",
+		}),
+		processingDuration: prom.NewHistogramVec(prom.HistogramOpts{
+			Name: "foxwaf_processing_duration_seconds",
+			Help: "Time spent processing the request phases and the response body phase.",
+		}, []string{"phase"}),
+		matchedRules: prom.NewHistogram(prom.HistogramOpts{
+			Name:    "foxwaf_matched_rules",
+			Help:    "Number of rules matched per transaction.",
+			Buckets: []float64{0, 1, 2, 5, 10, 20, 50},
+		}),
+		unsampledRequests: prom.NewCounter(prom.CounterOpts{
+			Name: "foxwaf_unsampled_requests_total",
+			Help: "Number of requests passed through without inspection because they were not sampled.",
+		}),
+		interruptions: prom.NewCounterVec(prom.CounterOpts{
+			Name: "foxwaf_interruptions_total",
+			Help: "Number of interrupted transactions.",
+		}, []string{"phase", "rule_id", "action"}),
+	}
+
+	for _, c := range []prom.Collector{
+		r.requestBodyBytes,
+		r.responseBodyBytes,
+		r.handlerDuration,
+		r.overheadDuration,
+		r.processingDuration,
+		r.matchedRules,
+		r.unsampledRequests,
+		r.interruptions,
+	} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// ObserveRequestBodyBytes implements [foxwaf.Recorder].
+func (r *Recorder) ObserveRequestBodyBytes(n int, inspected bool) {
+	r.requestBodyBytes.WithLabelValues(strconv.FormatBool(inspected)).Add(float64(n))
+}
+
+// ObserveResponseBodyBytes implements [foxwaf.Recorder].
+func (r *Recorder) ObserveResponseBodyBytes(n int, inspected bool) {
+	r.responseBodyBytes.WithLabelValues(strconv.FormatBool(inspected)).Add(float64(n))
+}
+
+// ObserveDuration implements [foxwaf.Recorder].
+func (r *Recorder) ObserveDuration(handler, overhead time.Duration) {
+	r.handlerDuration.Observe(handler.Seconds())
+	r.overheadDuration.Observe(overhead.Seconds())
+}
+
+// ObserveMatchedRules implements [foxwaf.Recorder].
+func (r *Recorder) ObserveMatchedRules(n int) {
+	r.matchedRules.Observe(float64(n))
+}
+
+// ObserveUnsampledRequest implements [foxwaf.Recorder].
+func (r *Recorder) ObserveUnsampledRequest() {
+	r.unsampledRequests.Inc()
+}
+
+// ObserveInterruption implements [foxwaf.Recorder].
+func (r *Recorder) ObserveInterruption(phase types.RulePhase, ruleID int, action string) {
+	r.interruptions.WithLabelValues(strconv.Itoa(int(phase)), strconv.Itoa(ruleID), action).Inc()
+}
+
+// ObserveProcessingDuration implements [foxwaf.Recorder].
+func (r *Recorder) ObserveProcessingDuration(phase types.RulePhase, d time.Duration) {
+	r.processingDuration.WithLabelValues(strconv.Itoa(int(phase))).Observe(d.Seconds())
+}
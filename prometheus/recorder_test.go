@@ -0,0 +1,115 @@
+// Copyright 2024 Sylvain Müller.
+// SPDX-License-Identifier: Apache-2.0
+
+package prometheus
+
+import (
+	"github.com/corazawaf/coraza/v3/types"
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"testing"
+	"time"
+)
+
+func TestRecorder(t *testing.T) {
+	reg := prom.NewRegistry()
+	r, err := NewRecorder(reg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	r.ObserveRequestBodyBytes(10, true)
+	r.ObserveRequestBodyBytes(5, true)
+	r.ObserveRequestBodyBytes(3, false)
+	r.ObserveResponseBodyBytes(7, false)
+	r.ObserveUnsampledRequest()
+	r.ObserveUnsampledRequest()
+	r.ObserveInterruption(types.PhaseRequestHeaders, 1001, "deny")
+	r.ObserveDuration(2*time.Second, 500*time.Millisecond)
+	r.ObserveProcessingDuration(types.PhaseRequestBody, 250*time.Millisecond)
+	r.ObserveMatchedRules(0)
+	r.ObserveMatchedRules(3)
+
+	counters := []struct {
+		name string
+		c    prom.Collector
+		want float64
+	}{
+		{name: "inspected request body bytes", c: r.requestBodyBytes.WithLabelValues("true"), want: 15},
+		{name: "uninspected request body bytes", c: r.requestBodyBytes.WithLabelValues("false"), want: 3},
+		{name: "uninspected response body bytes", c: r.responseBodyBytes.WithLabelValues("false"), want: 7},
+		{name: "unsampled requests", c: r.unsampledRequests, want: 2},
+		{name: "interruptions", c: r.interruptions.WithLabelValues("1", "1001", "deny"), want: 1},
+	}
+	for _, tc := range counters {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := testutil.ToFloat64(tc.c); got != tc.want {
+				t.Errorf("value: got %v, want %v", got, tc.want)
+			}
+		})
+	}
+
+	histograms := []struct {
+		name      string
+		metric    string
+		wantCount uint64
+		wantSum   float64
+	}{
+		{name: "handler duration", metric: "foxwaf_handler_duration_seconds", wantCount: 1, wantSum: 2},
+		{name: "overhead duration", metric: "foxwaf_overhead_duration_seconds", wantCount: 1, wantSum: 0.5},
+		{name: "processing duration", metric: "foxwaf_processing_duration_seconds", wantCount: 1, wantSum: 0.25},
+		{name: "matched rules", metric: "foxwaf_matched_rules", wantCount: 2, wantSum: 3},
+	}
+	for _, tc := range histograms {
+		t.Run(tc.name, func(t *testing.T) {
+			h := gatherHistogram(t, reg, tc.metric)
+			if got := h.GetSampleCount(); got != tc.wantCount {
+				t.Errorf("count: got %d, want %d", got, tc.wantCount)
+			}
+			if got := h.GetSampleSum(); got != tc.wantSum {
+				t.Errorf("sum: got %v, want %v", got, tc.wantSum)
+			}
+		})
+	}
+
+	buckets := gatherHistogram(t, reg, "foxwaf_matched_rules").GetBucket()
+	wantBuckets := []uint64{1, 1, 1, 2, 2, 2, 2}
+	if len(buckets) != len(wantBuckets) {
+		t.Fatalf("buckets: got %d, want %d", len(buckets), len(wantBuckets))
+	}
+	for i, b := range buckets {
+		if got := b.GetCumulativeCount(); got != wantBuckets[i] {
+			t.Errorf("bucket le=%v: got %d, want %d", b.GetUpperBound(), got, wantBuckets[i])
+		}
+	}
+}
+
+func TestNewRecorder_AlreadyRegistered(t *testing.T) {
+	reg := prom.NewRegistry()
+	if _, err := NewRecorder(reg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := NewRecorder(reg); err == nil {
+		t.Error("expected an error when the metrics are already registered")
+	}
+}
+
+func gatherHistogram(t *testing.T, g prom.Gatherer, name string) *dto.Histogram {
+	t.Helper()
+	families, err := g.Gather()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, mf := range families {
+		if mf.GetName() == name {
+			metrics := mf.GetMetric()
+			if len(metrics) != 1 {
+				t.Fatalf("%s: got %d series, want 1", name, len(metrics))
+			}
+			return metrics[0].GetHistogram()
+		}
+	}
+	t.Fatalf("%s: metric not found", name)
+	return nil
+}
@@ -0,0 +1,81 @@
+// Copyright 2024 Sylvain Müller.
+// SPDX-License-Identifier: Apache-2.0
+
+package foxwaf
+
+import (
+	"hash/maphash"
+	"sync"
+	"time"
+)
+
+// rateLimitShards is the number of independently locked shards of the rate limiter, so that concurrent clients rarely
+// contend on the same lock, and each sweep only scans a fraction of the buckets.
+const rateLimitShards = 32
+
+// rateLimiter is an in-memory token bucket rate limiter, keyed by client IP.
+type rateLimiter struct {
+	shards [rateLimitShards]rateLimitShard
+	seed   maphash.Seed
+	window time.Duration
+	// rate is the number of tokens refilled per second, and burst the capacity of a bucket.
+	rate  float64
+	burst float64
+}
+
+type rateLimitShard struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(n int, window time.Duration) *rateLimiter {
+	l := &rateLimiter{
+		seed:   maphash.MakeSeed(),
+		window: window,
+		rate:   float64(n) / window.Seconds(),
+		burst:  float64(n),
+	}
+	for i := range l.shards {
+		l.shards[i].buckets = make(map[string]*bucket)
+	}
+	return l
+}
+
+// allow reports whether the client identified by key is allowed to make a request at the given time, consuming a
+// token if so.
+func (l *rateLimiter) allow(key string, now time.Time) bool {
+	s := &l.shards[maphash.String(l.seed, key)%rateLimitShards]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// A bucket idle for a whole window is full again, so it can be dropped to bound the memory usage.
+	if now.Sub(s.lastSweep) > l.window {
+		for k, b := range s.buckets {
+			if now.Sub(b.last) > l.window {
+				delete(s.buckets, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		s.buckets[key] = b
+	} else {
+		b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+		b.last = now
+	}
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,47 @@
+// Copyright 2024 Sylvain Müller.
+// SPDX-License-Identifier: Apache-2.0
+
+package foxwaf
+
+import (
+	"github.com/corazawaf/coraza/v3/types"
+	"maps"
+	"sync"
+)
+
+// RuleStats returns a snapshot of the number of times each rule matched over the lifetime of the [WAF], keyed by rule
+// id, to identify noisy rules to tune or remove. It returns nil unless enabled with WithRuleStats.
+func (w *WAF) RuleStats() map[int]uint64 {
+	if w.cfg.ruleStats == nil {
+		return nil
+	}
+	return w.cfg.ruleStats.snapshot()
+}
+
+// ruleStats counts the rule matches across transactions.
+type ruleStats struct {
+	mu     sync.Mutex
+	counts map[int]uint64
+}
+
+func newRuleStats() *ruleStats {
+	return &ruleStats{counts: make(map[int]uint64)}
+}
+
+// record counts the rules matched by a transaction.
+func (s *ruleStats) record(matched []types.MatchedRule) {
+	if len(matched) == 0 {
+		return
+	}
+	s.mu.Lock()
+	for _, mr := range matched {
+		s.counts[mr.Rule().ID()]++
+	}
+	s.mu.Unlock()
+}
+
+func (s *ruleStats) snapshot() map[int]uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return maps.Clone(s.counts)
+}
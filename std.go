@@ -0,0 +1,28 @@
+// Copyright 2024 Sylvain Müller.
+// SPDX-License-Identifier: Apache-2.0
+
+package foxwaf
+
+import (
+	"github.com/corazawaf/coraza/v3"
+	"github.com/tigerwill90/fox"
+	"net/http"
+)
+
+// StdMiddleware creates a new net/http middleware using the provided Coraza WAF instance, so that the same processing
+// can be applied to plain net/http handlers.
+func StdMiddleware(waf coraza.WAF, opts ...Option) func(http.Handler) http.Handler {
+	return NewWAF(waf, opts...).Handler
+}
+
+// Handler wraps next with the [WAF] processing. The request is processed exactly as with Intercept, by a Fox router
+// built once, without any route, which serves every request with the next handler. Options relying on the matched
+// route are not applicable, since there is no route.
+func (w *WAF) Handler(next http.Handler) http.Handler {
+	return fox.New(
+		fox.WithNoRouteHandler(func(c fox.Context) {
+			next.ServeHTTP(c.Writer(), c.Request())
+		}),
+		fox.WithMiddlewareFor(fox.NoRouteHandler, w.Intercept),
+	)
+}
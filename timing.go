@@ -0,0 +1,27 @@
+// Copyright 2024 Sylvain Müller.
+// SPDX-License-Identifier: Apache-2.0
+
+package foxwaf
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const headerServerTiming = "Server-Timing"
+
+// setServerTiming adds a Server-Timing header entry reporting the time spent processing the request phases and, if
+// started, the response body phase.
+func setServerTiming(h http.Header, req, resp time.Duration) {
+	v := "waf-req;dur=" + formatMillis(req)
+	if resp > 0 {
+		v += ", waf-resp;dur=" + formatMillis(resp)
+	}
+	h.Add(headerServerTiming, v)
+}
+
+// formatMillis formats d in milliseconds, as expected by the Server-Timing dur parameter.
+func formatMillis(d time.Duration) string {
+	return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64)
+}
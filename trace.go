@@ -0,0 +1,41 @@
+// Copyright 2024 Sylvain Müller.
+// SPDX-License-Identifier: Apache-2.0
+
+package foxwaf
+
+import (
+	"context"
+	"github.com/corazawaf/coraza/v3/types"
+)
+
+// Tracer starts the span covering the WAF processing of a request. It is a thin interface, so that an OpenTelemetry
+// tracer (or any other) can be wrapped without the core package depending on it. Implementations must be safe for
+// concurrent use.
+type Tracer interface {
+	// Start starts a span as a child of the span carried by ctx, if any.
+	Start(ctx context.Context, name string) Span
+}
+
+// Span is a span started by a [Tracer].
+type Span interface {
+	// SetAttribute sets an attribute on the span. The value is either a string or an int.
+	SetAttribute(key string, value any)
+	// AddEvent records an event with the given attributes on the span.
+	AddEvent(name string, attrs map[string]any)
+	// End ends the span.
+	End()
+}
+
+// traceInterruption records an interruption on the span, if any.
+func traceInterruption(span Span, it *types.Interruption, phase types.RulePhase) {
+	if span == nil {
+		return
+	}
+	span.SetAttribute("waf.rule_id", it.RuleID)
+	span.SetAttribute("waf.action", it.Action)
+	span.AddEvent("waf.interruption", map[string]any{
+		"waf.rule_id": it.RuleID,
+		"waf.action":  it.Action,
+		"waf.phase":   int(phase),
+	})
+}
@@ -0,0 +1,203 @@
+// Copyright 2024 Sylvain Müller.
+// SPDX-License-Identifier: Apache-2.0
+
+package foxwaf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ErrWebSocketViolation is returned when reading from a hijacked WebSocket connection whose message has been rejected
+// by the inspector registered with WithWebSocketInspector. The connection is closed.
+var ErrWebSocketViolation = errors.New("foxwaf: websocket message rejected by the inspector")
+
+// ErrWebSocketMessageTooLarge is returned when reading from a hijacked WebSocket connection whose frame or message
+// exceeds the size limit set with WithWebSocketInspector. The connection is closed.
+var ErrWebSocketMessageTooLarge = errors.New("foxwaf: websocket message too large")
+
+// defaultWebSocketMessageSize is the maximum size of a WebSocket message inspected when no limit is provided.
+const defaultWebSocketMessageSize = 1 << 20
+
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+)
+
+// wsConn is a hijacked connection feeding the messages sent by the client to an inspector, once reassembled from their
+// frames. The frames of a data message are held until the message is approved, so the handler never reads a rejected
+// message.
+type wsConn struct {
+	net.Conn
+	// r reads the bytes already buffered by the server before reading from the connection.
+	r       io.Reader
+	inspect func(payload []byte) bool
+	// max is the maximum size of a frame or message payload.
+	max     int
+	pending bytes.Buffer
+	// ready holds the frames released to the handler.
+	ready bytes.Buffer
+	// held holds the frames of the fragmented data message being received, and message its payload, if fragmented
+	// is true.
+	held       bytes.Buffer
+	message    bytes.Buffer
+	fragmented bool
+}
+
+// Read reads data from the connection. Messages are inspected as soon as they are complete, and only then released to
+// the caller. The connection is closed on the first rejected or oversized message.
+func (c *wsConn) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for c.ready.Len() == 0 {
+		n, err := c.r.Read(p)
+		if n > 0 {
+			c.pending.Write(p[:n])
+			if err := c.inspectFrames(); err != nil {
+				_ = c.Conn.Close()
+				return 0, err
+			}
+		}
+		if err != nil && c.ready.Len() == 0 {
+			return 0, err
+		}
+	}
+	return c.ready.Read(p)
+}
+
+// inspectFrames consumes all complete frames pending in the buffer, inspects the data messages they complete and
+// releases the approved ones. It returns an error if a message is rejected, or if a frame or message exceeds the size
+// limit.
+func (c *wsConn) inspectFrames() error {
+	for {
+		fin, opcode, length, ok := parseFrameHeader(c.pending.Bytes())
+		if ok && length > uint64(c.max) {
+			// The frame is rejected as soon as its header is known, without buffering it.
+			return ErrWebSocketMessageTooLarge
+		}
+		payload, size, ok := parseFrame(c.pending.Bytes())
+		if !ok {
+			return nil
+		}
+		frame := c.pending.Next(size)
+
+		switch opcode {
+		case wsOpText, wsOpBinary:
+			// A message left unfinished is never released.
+			c.held.Reset()
+			c.message.Reset()
+			c.fragmented = false
+		case wsOpContinuation:
+			if !c.fragmented {
+				// A continuation frame without a started message is a protocol error, left to the handler to report.
+				c.ready.Write(frame)
+				continue
+			}
+		default:
+			// Control frames don't carry application data, and may be interleaved with the fragments of a message,
+			// in which case they are held along with them to preserve the order of the frames.
+			if c.fragmented {
+				c.held.Write(frame)
+			} else {
+				c.ready.Write(frame)
+			}
+			continue
+		}
+
+		if c.message.Len()+len(payload) > c.max {
+			return ErrWebSocketMessageTooLarge
+		}
+		if !fin {
+			c.held.Write(frame)
+			c.message.Write(payload)
+			c.fragmented = true
+			continue
+		}
+		if c.fragmented {
+			c.held.Write(frame)
+			c.message.Write(payload)
+			payload, frame = c.message.Bytes(), c.held.Bytes()
+		}
+		if !c.inspect(payload) {
+			return ErrWebSocketViolation
+		}
+		c.ready.Write(frame)
+		c.held.Reset()
+		c.message.Reset()
+		c.fragmented = false
+	}
+}
+
+// parseFrameHeader parses the header of the WebSocket frame at the start of b. It returns whether the frame is the
+// final fragment of a message, its opcode and its payload length, or false if the header is not complete yet.
+func parseFrameHeader(b []byte) (fin bool, opcode byte, length uint64, ok bool) {
+	if len(b) < 2 {
+		return
+	}
+	fin = b[0]&0x80 != 0
+	opcode = b[0] & 0x0f
+	length = uint64(b[1] & 0x7f)
+	switch length {
+	case 126:
+		if len(b) < 4 {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(b[2:4]))
+	case 127:
+		if len(b) < 10 {
+			return
+		}
+		length = binary.BigEndian.Uint64(b[2:10])
+	}
+	return fin, opcode, length, true
+}
+
+// parseFrame parses the WebSocket frame at the start of b. It returns the unmasked payload and the size of the frame,
+// or false if the frame is not complete yet.
+func parseFrame(b []byte) (payload []byte, size int, ok bool) {
+	_, _, length, ok := parseFrameHeader(b)
+	if !ok {
+		return nil, 0, false
+	}
+	offset := 2
+	switch b[1] & 0x7f {
+	case 126:
+		offset = 4
+	case 127:
+		offset = 10
+	}
+
+	var key []byte
+	if b[1]&0x80 != 0 {
+		if len(b) < offset+4 {
+			return nil, 0, false
+		}
+		key = b[offset : offset+4]
+		offset += 4
+	}
+
+	if uint64(len(b)-offset) < length {
+		return nil, 0, false
+	}
+	size = offset + int(length)
+	payload = make([]byte, length)
+	copy(payload, b[offset:size])
+	for i := range key {
+		for j := i; j < len(payload); j += 4 {
+			payload[j] ^= key[i]
+		}
+	}
+	return payload, size, true
+}
+
+// isWebSocketUpgrade reports whether r is a WebSocket handshake request.
+func isWebSocketUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
@@ -9,6 +9,9 @@ package foxwaf
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
 	"github.com/corazawaf/coraza/v3/types"
 	"github.com/tigerwill90/fox"
 	"io"
@@ -16,12 +19,19 @@ import (
 	"net"
 	"net/http"
 	"path"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
 var _ fox.ResponseWriter = (*rwInterceptor)(nil)
 
+// ErrFlushPendingInspection is returned when flushing a response whose body is held or buffered until the response
+// body phase completes.
+var ErrFlushPendingInspection = errors.New("foxwaf: cannot flush a response body pending inspection")
+
 var copyBufPool = sync.Pool{
 	New: func() any {
 		b := make([]byte, 32*1024)
@@ -31,14 +41,53 @@ var copyBufPool = sync.Pool{
 
 const notWritten = -1
 
+// statusNoResponse is the status code sent in place of a "drop" interruption when the connection can't be closed
+// abruptly, as nginx does.
+const statusNoResponse = 444
+
+const maxHeldBufferSize = 64 * 1024
+
+const headerVerdict = "X-WAF-Verdict"
+
+// Reasons reported by ResponseInspected when the response body is not inspected.
+const (
+	reasonNotWritten     = "response not written"
+	reasonInterrupted    = "interrupted by response headers rules"
+	reasonDemoted        = "interruption demoted"
+	reasonBodyAccess     = "response body access disabled"
+	reasonNotProcessable = "content type not processable"
+	reasonNotSelected    = "content type not selected for inspection"
+	reasonTooManyBuffers = "too many concurrent response buffers"
+	reasonBypassed       = "response body bypassed"
+	reasonPartialContent = "partial content response"
+	reasonSpilled        = "response body spilled to stream"
+)
+
 type rwInterceptor struct {
 	w                  fox.ResponseWriter
 	tx                 types.Transaction
+	cfg                *config
 	proto              string
 	statusCode         int
 	size               int
 	isWriteHeaderFlush bool
 	wroteHeader        bool
+	headerPending      bool
+	held               bytes.Buffer
+	demoted            bool
+	detected           bool
+	blocked            bool
+	bufferBody         bool
+	holdBody           bool
+	acceptsGzip        bool
+	websocket          bool
+	preflight          bool
+	buffering          bool
+	info               *requestInfo
+	ctx                fox.Context
+	span               Span
+	requestDuration    time.Duration
+	responseStart      time.Time
 }
 
 // Status recorded after Write and WriteHeader.
@@ -62,13 +111,42 @@ func (w *rwInterceptor) Size() int {
 // WriteHeader records the status code to be sent right before the moment
 // the body is being written.
 func (w *rwInterceptor) WriteHeader(statusCode int) {
-	if w.wroteHeader {
+	if w.wroteHeader || w.headerPending {
 		caller := relevantCaller()
 		log.Printf("http: superfluous response.WriteHeader call from %s (%s:%d)", caller.Function, path.Base(caller.File), caller.Line)
 		return
 	}
 
+	// Without a Content-Type, net/http sniffs it from the first bytes written, so the response headers are only
+	// processed on the first write, with the sniffed Content-Type.
+	if w.needsSniffing() && statusCode >= http.StatusOK && statusCode != http.StatusNoContent && statusCode != http.StatusNotModified {
+		w.statusCode = statusCode
+		w.size = 0
+		w.headerPending = true
+		return
+	}
+	w.writeHeader(statusCode)
+}
+
+// resolveHeader processes the response headers with the status code recorded by a pending WriteHeader call, or a
+// 200 OK if none.
+func (w *rwInterceptor) resolveHeader() {
+	statusCode := http.StatusOK
+	if w.headerPending {
+		statusCode = w.statusCode
+	}
+	w.writeHeader(statusCode)
+}
+
+// writeHeader processes the response headers and decides whether the body has to be buffered for inspection.
+func (w *rwInterceptor) writeHeader(statusCode int) {
+	w.headerPending = false
 	for k, vv := range w.w.Header() {
+		// Response headers rules must still run to enable the response body processing, so we feed them only with
+		// the Content-Type, which decides whether the body is processable.
+		if w.cfg.skipResponseHeaders && k != "Content-Type" {
+			continue
+		}
 		for _, v := range vv {
 			w.tx.AddResponseHeader(k, v)
 		}
@@ -76,14 +154,44 @@ func (w *rwInterceptor) WriteHeader(statusCode int) {
 
 	w.statusCode = statusCode
 	w.size = 0
-	if it := w.tx.ProcessResponseHeaders(statusCode, w.proto); it != nil {
-		w.cleanHeaders()
-		w.Header().Set("Content-Length", "0")
-		w.statusCode = obtainStatusCodeFromInterruptionOrDefault(it, w.statusCode)
-		w.flushWriteHeader()
-		return
+	// The transaction is no longer inspected once an interruption has been demoted.
+	if !w.demoted {
+		if it := w.tx.ProcessResponseHeaders(statusCode, w.proto); isBlocking(w.tx, it, w.cfg) {
+			w.recordInspection(false, reasonInterrupted)
+			w.interrupt(it, types.PhaseResponseHeaders)
+			return
+		} else if it != nil {
+			w.demoted = true
+		}
 	}
 
+	// Response headers are now known, so we can decide whether the body has to be buffered for inspection.
+	reason := reasonDemoted
+	if !w.demoted {
+		w.bufferBody, reason = w.shouldBufferBody()
+	}
+	w.holdBody = !w.bufferBody && w.cfg.holdResponse
+	// Streaming responses must be written straight to the client, response headers rules have run anyway.
+	if (w.bufferBody || w.holdBody) && w.cfg.bodyBypass != nil && w.cfg.bodyBypass(w.w.Header()) {
+		w.bufferBody = false
+		w.holdBody = false
+		reason = reasonBypassed
+	}
+	// A range response only carries a fragment of the representation, which can't be meaningfully inspected, and
+	// would be corrupted by a rewrite or compression, so it is always passed through.
+	if (w.bufferBody || w.holdBody) && statusCode == http.StatusPartialContent {
+		w.bufferBody = false
+		w.holdBody = false
+		reason = reasonPartialContent
+	}
+	// Responses beyond the concurrent buffers limit are streamed uninspected rather than blocked.
+	if (w.bufferBody || w.holdBody) && !w.acquireBuffer() {
+		w.tx.DebugLogger().Debug().Msg("Too many concurrent response buffers, the response body is not inspected")
+		w.bufferBody = false
+		w.holdBody = false
+		reason = reasonTooManyBuffers
+	}
+	w.recordInspection(w.bufferBody, reason)
 	w.wroteHeader = true
 }
 
@@ -93,7 +201,7 @@ func (w *rwInterceptor) WriteHeader(statusCode int) {
 // If the body isn't accessible or the mime type isn't processable, the response
 // body is being writen to the delegate response writer directly.
 func (w *rwInterceptor) Write(b []byte) (int, error) {
-	if w.tx.IsInterrupted() {
+	if w.interrupted() {
 		// if there is an interruption it must be from at least phase 4 and hence
 		// WriteHeader or Write should have been called and hence the status code
 		// has been flushed to the delegated response writer.
@@ -101,25 +209,102 @@ func (w *rwInterceptor) Write(b []byte) (int, error) {
 	}
 
 	if !w.wroteHeader {
+		// The content type must be known before response headers are processed, so it can't be left to net/http.
+		w.sniffContentType(b)
 		// if no header has been wrote at this point we aim to return 200
-		w.WriteHeader(http.StatusOK)
+		w.resolveHeader()
 	}
 
-	if w.tx.IsResponseBodyAccessible() && w.tx.IsResponseBodyProcessable() {
+	if w.bufferBody {
+		// The body must be rewritten before being inspected, so it is held until the response body phase.
+		if w.cfg.responseRewriter != nil {
+			if max := w.heldLimit(); max > 0 && w.held.Len()+len(b) > max {
+				return w.abandonRewrite(b)
+			}
+			n, _ := w.held.Write(b)
+			w.size += n
+			if w.cfg.recorder != nil {
+				w.cfg.recorder.ObserveResponseBodyBytes(n, true)
+			}
+			return n, nil
+		}
+
+		// Past the spill threshold, the inspection is abandoned rather than buffering an unexpectedly large body.
+		if w.cfg.spillThreshold > 0 && w.size+len(b) > w.cfg.spillThreshold {
+			w.tx.DebugLogger().Debug().Msg("Response body exceeds the spill threshold, the response body is not inspected")
+			w.recordInspection(false, reasonSpilled)
+			if err := w.spill(); err != nil {
+				return 0, err
+			}
+			n, err := w.w.Write(b)
+			w.size += n
+			if w.cfg.recorder != nil {
+				w.cfg.recorder.ObserveResponseBodyBytes(n, false)
+			}
+			return n, err
+		}
+
+		// With WithResponsePrefixInspection, only the bytes up to the prefix size are buffered.
+		chunk := b
+		if w.cfg.responsePrefix > 0 && w.size+len(b) > w.cfg.responsePrefix {
+			chunk = b[:w.cfg.responsePrefix-w.size]
+		}
+
 		// we only buffer the response body if we are going to access
 		// to it, otherwise we just send it to the response writer.
-		it, n, err := w.tx.WriteResponseBody(b)
-		if it != nil {
-			// if there is an interruption we must clean the headers and override the status code
-			w.cleanHeaders()
-			w.Header().Set("Content-Length", "0")
-			w.overrideWriteHeader(obtainStatusCodeFromInterruptionOrDefault(it, w.statusCode))
+		it, n, err := w.tx.WriteResponseBody(chunk)
+		if isBlocking(w.tx, it, w.cfg) {
 			// We only flush the status code after an interruption.
-			w.flushWriteHeader()
+			w.interrupt(it, types.PhaseResponseBody)
 			return 0, nil
+		} else if it != nil {
+			// The interruption is demoted, so we release what has been buffered so far and pass the remaining
+			// bytes through.
+			w.demoted = true
+			w.recordInspection(false, reasonDemoted)
+			w.size += n
+			if err := w.spill(); err != nil {
+				return n, err
+			}
+			m, err := w.w.Write(b[n:])
+			w.size += m
+			return n + m, err
 		}
 		w.size += n
-		return n, err
+		if w.cfg.recorder != nil {
+			w.cfg.recorder.ObserveResponseBodyBytes(n, true)
+		}
+		if err != nil || w.cfg.responsePrefix <= 0 || w.size < w.cfg.responsePrefix {
+			return n, err
+		}
+
+		// The prefix is complete, so the response body rules run on it and the remaining bytes pass through.
+		if it, err := w.tx.ProcessResponseBody(); err != nil {
+			return n, err
+		} else if isBlocking(w.tx, it, w.cfg) {
+			w.interrupt(it, types.PhaseResponseBody)
+			return 0, nil
+		}
+		if err := w.spill(); err != nil {
+			return n, err
+		}
+		m, err := w.w.Write(b[n:])
+		w.size += m
+		if w.cfg.recorder != nil {
+			w.cfg.recorder.ObserveResponseBodyBytes(m, false)
+		}
+		return n + m, err
+	}
+
+	if w.holdBody {
+		// The body is not inspected, but we hold it until the response body phase completes, so any applicable
+		// rule can still block the response before the client sees any byte.
+		n, _ := w.held.Write(b)
+		w.size += n
+		if w.cfg.recorder != nil {
+			w.cfg.recorder.ObserveResponseBodyBytes(n, false)
+		}
+		return n, nil
 	}
 
 	// flush the status code before writing
@@ -129,6 +314,9 @@ func (w *rwInterceptor) Write(b []byte) (int, error) {
 	// directly to the caller.
 	n, err := w.w.Write(b)
 	w.size += n
+	if w.cfg.recorder != nil {
+		w.cfg.recorder.ObserveResponseBodyBytes(n, false)
+	}
 	return n, err
 }
 
@@ -136,6 +324,16 @@ func (w *rwInterceptor) Write(b []byte) (int, error) {
 // as part of an HTTP reply. The method returns the number of bytes written
 // and an error, if any.
 func (w *rwInterceptor) WriteString(s string) (n int, err error) {
+	// Once the status is known, a response passed through is written as is, without converting it to a byte slice.
+	if w.wroteHeader && !w.bufferBody && !w.holdBody && !w.interrupted() {
+		w.flushWriteHeader()
+		n, err = w.w.WriteString(s)
+		w.size += n
+		if w.cfg.recorder != nil {
+			w.cfg.recorder.ObserveResponseBodyBytes(n, false)
+		}
+		return n, err
+	}
 	return io.WriteString(onlyWrite{w}, s)
 }
 
@@ -150,12 +348,21 @@ func (w *rwInterceptor) ReadFrom(src io.Reader) (n int64, err error) {
 	return
 }
 
-// FlushError flushes buffered data to the client.
+// FlushError flushes buffered data to the client. A response body pending inspection can't be flushed before the
+// response body phase completes, in which case ErrFlushPendingInspection is returned. The writer does not implement
+// http.Flusher, which can't report this error, so handlers should flush through http.ResponseController.
 func (w *rwInterceptor) FlushError() error {
 	if !w.wroteHeader {
-		w.WriteHeader(http.StatusOK)
+		w.resolveHeader()
 	}
-	return nil
+	if w.interrupted() {
+		return nil
+	}
+	if w.bufferBody || w.holdBody {
+		return ErrFlushPendingInspection
+	}
+	w.flushWriteHeader()
+	return w.w.FlushError()
 }
 
 // Push initiates an HTTP/2 server push. Push returns http.ErrNotSupported if the client has disabled push or if push
@@ -166,8 +373,15 @@ func (w *rwInterceptor) Push(target string, opts *http.PushOptions) error {
 
 // Hijack lets the caller take over the connection. If hijacking the connection is not supported, Hijack returns
 // an error matching http.ErrNotSupported. See http.Hijacker for more details.
+// If a WebSocket inspector is registered and the request is a WebSocket handshake, the payload of the frames sent by
+// the client over the returned connection is fed to the inspector.
 func (w *rwInterceptor) Hijack() (net.Conn, *bufio.ReadWriter, error) {
-	return w.w.Hijack()
+	conn, brw, err := w.w.Hijack()
+	if err != nil || !w.websocket {
+		return conn, brw, err
+	}
+	wc := &wsConn{Conn: conn, r: brw.Reader, inspect: w.cfg.wsInspector, max: w.cfg.wsMaxMessageSize}
+	return wc, bufio.NewReadWriter(bufio.NewReader(wc), brw.Writer), nil
 }
 
 func (w *rwInterceptor) Header() http.Header {
@@ -194,14 +408,184 @@ func (w *rwInterceptor) EnableFullDuplex() error {
 	return fox.ErrNotSupported()
 }
 
-func (w *rwInterceptor) reset(tx types.Transaction, writer fox.ResponseWriter, proto string) {
+func (w *rwInterceptor) reset(tx types.Transaction, writer fox.ResponseWriter, req *http.Request, cfg *config) {
 	w.w = writer
 	w.tx = tx
+	w.cfg = cfg
 	w.statusCode = http.StatusOK
-	w.proto = proto
+	w.proto = req.Proto
+	w.acceptsGzip = cfg.compress && acceptsGzip(req.Header.Values("Accept-Encoding"))
+	w.websocket = cfg.wsInspector != nil && isWebSocketUpgrade(req)
+	w.preflight = req.Method == http.MethodOptions
 	w.size = notWritten
 	w.isWriteHeaderFlush = false
 	w.wroteHeader = false
+	w.headerPending = false
+	w.demoted = false
+	w.detected = false
+	w.blocked = false
+	w.bufferBody = false
+	w.holdBody = false
+	w.buffering = false
+	w.info = nil
+	w.ctx = nil
+	w.span = nil
+	w.requestDuration = 0
+	w.responseStart = time.Time{}
+	w.held.Reset()
+}
+
+// putInterceptor returns the interceptor to the pool, dropping its held buffer if it grew too large so that the pool
+// doesn't retain it.
+func putInterceptor(w *rwInterceptor) {
+	if w.held.Cap() > maxHeldBufferSize {
+		w.held = bytes.Buffer{}
+	}
+	p.Put(w)
+}
+
+// shouldBufferBody reports whether the response body must be buffered for inspection, and the reason why if not.
+// Response headers must be processed before this.
+func (w *rwInterceptor) shouldBufferBody() (bool, string) {
+	if !w.tx.IsResponseBodyAccessible() {
+		return false, reasonBodyAccess
+	}
+	if !w.tx.IsResponseBodyProcessable() {
+		return false, reasonNotProcessable
+	}
+	if len(w.cfg.responseInspectTypes) > 0 && !slices.Contains(w.cfg.responseInspectTypes, mediaType(w.w.Header().Get("Content-Type"))) {
+		return false, reasonNotSelected
+	}
+	return true, ""
+}
+
+// recordInspection records whether the response body is inspected, and the reason why if not, for ResponseInspected.
+func (w *rwInterceptor) recordInspection(inspected bool, reason string) {
+	if w.info != nil {
+		w.info.responseInspected = inspected
+		w.info.responseReason = reason
+	}
+}
+
+// writeBody sends the body held or buffered for inspection to the delegate writer. With WithChunkedFlush, the body is
+// sent in chunks, flushed one by one.
+func (w *rwInterceptor) writeBody(r io.Reader) error {
+	if w.cfg.flushChunkSize <= 0 {
+		_, err := io.Copy(w.w, r)
+		return err
+	}
+
+	buf := make([]byte, w.cfg.flushChunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if _, err := w.w.Write(buf[:n]); err != nil {
+				return err
+			}
+			if err := w.w.FlushError(); err != nil {
+				return err
+			}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// rewrite applies the response rewriter to the held body and updates the recorded size and the Content-Length header,
+// if any, accordingly.
+func (w *rwInterceptor) rewrite() []byte {
+	body := w.cfg.responseRewriter(w.w.Header().Get("Content-Type"), w.held.Bytes())
+	w.size = len(body)
+	if w.w.Header().Get("Content-Length") != "" {
+		w.w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	return body
+}
+
+// heldLimit returns the maximum size of a response body held for a rewrite: the spill threshold if any, otherwise the
+// Coraza response body limit, or 0 if unknown.
+func (w *rwInterceptor) heldLimit() int {
+	if w.cfg.spillThreshold > 0 {
+		return w.cfg.spillThreshold
+	}
+	return int(bodyLimit(w.tx, "ResponseBodyLimit"))
+}
+
+// abandonRewrite gives up the rewrite of a held response body about to exceed its limit. Past the spill threshold,
+// the held bytes are sent uninspected. Past the Coraza response body limit, they are fed to Coraza first, so its limit
+// action applies: the response is blocked with Reject, or the held bytes are sent once the first bytes have been
+// inspected with ProcessPartial. In both cases, b and the rest of the body stream through.
+func (w *rwInterceptor) abandonRewrite(b []byte) (int, error) {
+	if w.cfg.spillThreshold <= 0 {
+		for _, chunk := range [][]byte{w.held.Bytes(), b} {
+			it, _, err := w.tx.WriteResponseBody(chunk)
+			if err != nil {
+				return 0, err
+			}
+			if isBlocking(w.tx, it, w.cfg) {
+				w.interrupt(it, types.PhaseResponseBody)
+				return 0, nil
+			}
+			if it != nil {
+				break
+			}
+		}
+	}
+
+	w.tx.DebugLogger().Debug().Msg("Response body held for a rewrite exceeds its limit, the response body is not inspected")
+	w.recordInspection(false, reasonSpilled)
+	w.bufferBody = false
+	w.flushWriteHeader()
+	if _, err := w.held.WriteTo(w.w); err != nil {
+		return 0, fmt.Errorf("failed to copy the response body: %w", err)
+	}
+	n, err := w.w.Write(b)
+	w.size += n
+	if w.cfg.recorder != nil {
+		w.cfg.recorder.ObserveResponseBodyBytes(n, false)
+	}
+	return n, err
+}
+
+// sniffContentType sets the Content-Type header from the first bytes of the body if the handler did not set one, as
+// net/http would do. Like net/http, a Content-Type header explicitly set to nil disables sniffing.
+func (w *rwInterceptor) sniffContentType(b []byte) {
+	if !w.needsSniffing() || len(b) == 0 {
+		return
+	}
+	w.w.Header().Set("Content-Type", http.DetectContentType(b))
+}
+
+// needsSniffing reports whether the Content-Type is left to be sniffed from the first bytes of the body.
+func (w *rwInterceptor) needsSniffing() bool {
+	h := w.w.Header()
+	_, haveType := h["Content-Type"]
+	return !haveType && h.Get("Transfer-Encoding") == ""
+}
+
+// acquireBuffer reserves one of the concurrent response buffers, if limited. It reports false if none is available.
+func (w *rwInterceptor) acquireBuffer() bool {
+	if w.cfg.maxResponseBuffers <= 0 {
+		return true
+	}
+	if w.cfg.responseBuffers.Add(1) > w.cfg.maxResponseBuffers {
+		w.cfg.responseBuffers.Add(-1)
+		return false
+	}
+	w.buffering = true
+	return true
+}
+
+// releaseBuffer releases the concurrent response buffer reserved by acquireBuffer, if any.
+func (w *rwInterceptor) releaseBuffer() {
+	if w.buffering {
+		w.cfg.responseBuffers.Add(-1)
+		w.buffering = false
+	}
 }
 
 // overrideWriteHeader overrides the recorded status code
@@ -213,13 +597,133 @@ func (w *rwInterceptor) overrideWriteHeader(statusCode int) {
 // flushWriteHeader sends the status code to the delegate writers
 func (w *rwInterceptor) flushWriteHeader() {
 	if !w.isWriteHeaderFlush {
+		if w.cfg.wouldBlockHeaders {
+			setWouldBlockHeaders(w.tx, w.w.Header(), w.cfg.wouldBlockStatuses)
+		}
+		if w.cfg.verdictTrailer {
+			w.w.Header().Add("Trailer", headerVerdict)
+		}
+		if w.cfg.serverTiming {
+			var resp time.Duration
+			if !w.responseStart.IsZero() {
+				resp = time.Since(w.responseStart)
+			}
+			setServerTiming(w.w.Header(), w.requestDuration, resp)
+		}
 		w.w.WriteHeader(w.statusCode)
 		w.isWriteHeaderFlush = true
 	}
 }
 
-// cleanHeaders removes all headers from the response
+// writeError sends a 500 Internal Server Error to the delegate writer when the response can't be processed, along with
+// the body configured with WithResponseErrorBody, if any. The headers set by the handler are cleaned beforehand.
+func (w *rwInterceptor) writeError() {
+	w.held.Reset()
+	w.cleanHeaders()
+	w.overrideWriteHeader(http.StatusInternalServerError)
+	h := w.w.Header()
+	if len(w.cfg.responseErrorBody) == 0 {
+		h.Set("Content-Length", "0")
+		w.flushWriteHeader()
+		return
+	}
+	h.Set("Content-Type", w.cfg.responseErrorContentType)
+	h.Set("Content-Length", strconv.Itoa(len(w.cfg.responseErrorBody)))
+	w.flushWriteHeader()
+	_, _ = w.w.Write(w.cfg.responseErrorBody)
+}
+
+// interrupt cleans the headers, overrides the status code with the one derived from the interruption and sends it
+// to the delegate writer along with the configured block body, if any.
+func (w *rwInterceptor) interrupt(it *types.Interruption, phase types.RulePhase) {
+	// Both a write and the response processing may report the response body phase, the response is only interrupted
+	// and notified once.
+	if w.blocked {
+		return
+	}
+	w.blocked = true
+	// The interruption is exposed to the interruption callbacks.
+	w.ctx.SetRequest(withInterruption(w.ctx.Request(), &Result{Interruption: it, Rule: interruptionRule(w.tx, it), Phase: phase}))
+	// The held body must never reach the client.
+	w.held.Reset()
+	w.cleanHeaders()
+	if it.Action == "drop" {
+		traceInterruption(w.span, it, phase)
+		w.cfg.notifyInterruption(w.ctx, it, phase)
+		w.overrideWriteHeader(statusNoResponse)
+		if dropConnection(w.w) {
+			// Nothing can be written to a closed connection.
+			w.isWriteHeaderFlush = true
+			return
+		}
+		w.w.Header().Set("Content-Length", "0")
+		w.flushWriteHeader()
+		return
+	}
+	w.overrideWriteHeader(obtainStatusCodeFromInterruptionOrDefault(it, w.cfg, w.statusCode))
+	body := w.cfg.blockBodyFor(w.ctx, w.w.Header(), w.statusCode, it)
+	if w.preflight {
+		w.cfg.setPreflightCORSHeaders(w.w.Header())
+	}
+	traceInterruption(w.span, it, phase)
+	w.cfg.notifyInterruption(w.ctx, it, phase)
+	w.flushWriteHeader()
+	if len(body) > 0 {
+		n, _ := w.w.Write(body)
+		w.size += n
+	}
+}
+
+// dropConnection abruptly closes the connection underlying w, without response, to honor a "drop" interruption. It
+// reports false if the connection can't be hijacked (e.g. HTTP/2), in which case the caller must fall back to an empty
+// response with statusNoResponse.
+func dropConnection(w fox.ResponseWriter) bool {
+	conn, _, err := w.Hijack()
+	if err != nil {
+		return false
+	}
+	_ = conn.Close()
+	return true
+}
+
+// interrupted reports whether the transaction has been interrupted by a blocking rule.
+func (w *rwInterceptor) interrupted() bool {
+	return !w.demoted && !w.detected && w.tx.IsInterrupted()
+}
+
+// spill sends the response body buffered so far to the delegate writer and switches to pass-through for the
+// remaining of the response.
+func (w *rwInterceptor) spill() error {
+	w.bufferBody = false
+	reader, err := w.tx.ResponseBodyReader()
+	if err != nil {
+		return fmt.Errorf("failed to release the response body reader: %w", err)
+	}
+	w.flushWriteHeader()
+	if _, err := io.Copy(w.w, reader); err != nil {
+		return fmt.Errorf("failed to copy the response body: %w", err)
+	}
+	return nil
+}
+
+// setVerdictTrailer sets the trailer carrying the final verdict of the transaction. It must be declared before the
+// status code is flushed.
+func (w *rwInterceptor) setVerdictTrailer() {
+	verdict := "pass"
+	if w.detected {
+		verdict = "detected"
+	} else if w.interrupted() {
+		verdict = "interrupted"
+	}
+	w.w.Header().Set(headerVerdict, verdict)
+}
+
+// cleanHeaders removes all headers from the response, unless a custom cleaner is configured with WithHeaderCleaner.
 func (w *rwInterceptor) cleanHeaders() {
+	if w.cfg.headerCleaner != nil {
+		w.cfg.headerCleaner(w.w.Header())
+		return
+	}
 	for k := range w.w.Header() {
 		w.w.Header().Del(k)
 	}
@@ -228,3 +732,52 @@ func (w *rwInterceptor) cleanHeaders() {
 type onlyWrite struct {
 	io.Writer
 }
+
+// stripWriter removes the headers configured with WithStripResponseHeaders right before the status code is sent. It
+// wraps the writer of every request, whether or not it is inspected, so the headers never leak. An inspected response
+// is written through it once the response headers rules have run, so they can still detect the headers.
+type stripWriter struct {
+	fox.ResponseWriter
+	names []string
+}
+
+func (w *stripWriter) WriteHeader(statusCode int) {
+	w.strip()
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *stripWriter) Write(b []byte) (int, error) {
+	w.strip()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *stripWriter) WriteString(s string) (int, error) {
+	w.strip()
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *stripWriter) ReadFrom(src io.Reader) (int64, error) {
+	w.strip()
+	return w.ResponseWriter.ReadFrom(src)
+}
+
+func (w *stripWriter) FlushError() error {
+	w.strip()
+	return w.ResponseWriter.FlushError()
+}
+
+// strip removes the headers, unless they have already been sent.
+func (w *stripWriter) strip() {
+	if w.ResponseWriter.Written() {
+		return
+	}
+	for _, name := range w.names {
+		w.ResponseWriter.Header().Del(name)
+	}
+}
+
+// mediaType returns the lower-cased media type of a Content-Type header value, without its parameters.
+func mediaType(ct string) string {
+	mt, _, _ := strings.Cut(ct, ";")
+	return strings.ToLower(strings.TrimSpace(mt))
+}
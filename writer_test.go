@@ -0,0 +1,1491 @@
+// Copyright 2024 Sylvain Müller.
+// SPDX-License-Identifier: Apache-2.0
+
+package foxwaf
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/corazawaf/coraza/v3"
+	"github.com/corazawaf/coraza/v3/types"
+	"github.com/tigerwill90/fox"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWithWouldBlockHeaders(t *testing.T) {
+	cases := []struct {
+		name       string
+		directives string
+		wantStatus string
+	}{
+		{
+			name:       "deny with status",
+			directives: `SecRule ARGS:id "@eq 0" "id:1,phase:1,deny,status:406"`,
+			wantStatus: "406",
+		},
+		{
+			name:       "deny with a message containing a comma",
+			directives: `SecRule ARGS:id "@eq 0" "id:1,phase:1,deny,msg:'a, b, pass'"`,
+			wantStatus: "403",
+		},
+		{
+			name: "chained rule",
+			directives: `
+				SecRule ARGS:id "@eq 0" "id:1,phase:1,chain,deny,status:401"
+					SecRule REQUEST_METHOD "@streq GET" "t:none"
+			`,
+			wantStatus: "401",
+		},
+		{
+			name: "block resolved to the default deny",
+			directives: `
+				SecDefaultAction "phase:1,log,auditlog,deny,status:418"
+				SecRule ARGS:id "@eq 0" "id:1,phase:1,block"
+			`,
+			wantStatus: "418",
+		},
+		{
+			name: "block resolved to the default pass",
+			directives: `
+				SecDefaultAction "phase:1,log,auditlog,pass"
+				SecRule ARGS:id "@eq 0" "id:1,phase:1,block"
+			`,
+		},
+		{
+			name:       "pass",
+			directives: `SecRule ARGS:id "@eq 0" "id:1,phase:1,pass,log"`,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			waf := newTestWAF(t, "SecRuleEngine DetectionOnly\n"+tc.directives)
+			req := httptest.NewRequest(http.MethodGet, "/?id=0", nil)
+			w := serve(req, ok, Middleware(waf, WithWouldBlockHeaders(true)))
+			if w.Code != http.StatusOK {
+				t.Errorf("status: got %d, want %d", w.Code, http.StatusOK)
+			}
+			if got := w.Header().Get(headerWouldStatus); got != tc.wantStatus {
+				t.Errorf("would status: got %q, want %q", got, tc.wantStatus)
+			}
+			if got, want := w.Header().Get(headerWouldBlock) == "true", tc.wantStatus != ""; got != want {
+				t.Errorf("would block: got %t, want %t", got, want)
+			}
+		})
+	}
+}
+
+// wsFrame encodes a masked WebSocket frame, as sent by a client.
+func wsFrame(fin bool, opcode byte, payload string) []byte {
+	b := []byte{opcode, 0x80}
+	if fin {
+		b[0] |= 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		b[1] |= byte(n)
+	case n <= 0xffff:
+		b[1] |= 126
+		b = binary.BigEndian.AppendUint16(b, uint16(n))
+	default:
+		b[1] |= 127
+		b = binary.BigEndian.AppendUint64(b, uint64(n))
+	}
+	key := []byte{1, 2, 3, 4}
+	b = append(b, key...)
+	for i := range len(payload) {
+		b = append(b, payload[i]^key[i%4])
+	}
+	return b
+}
+
+func TestWebSocketInspector(t *testing.T) {
+	const wsOpPing = 0x9
+
+	cases := []struct {
+		name         string
+		frames       [][]byte
+		wantMessages []string
+		// wantRead is the number of leading frames released to the reader.
+		wantRead int
+		wantErr  error
+	}{
+		{
+			name:         "single frame messages",
+			frames:       [][]byte{wsFrame(true, wsOpText, "hello"), wsFrame(true, wsOpBinary, "world")},
+			wantMessages: []string{"hello", "world"},
+			wantRead:     2,
+			wantErr:      io.EOF,
+		},
+		{
+			name: "fragmented message is reassembled",
+			frames: [][]byte{
+				wsFrame(false, wsOpText, "hel"),
+				wsFrame(true, wsOpPing, ""),
+				wsFrame(false, wsOpContinuation, "lo "),
+				wsFrame(true, wsOpContinuation, "world"),
+			},
+			wantMessages: []string{"hello world"},
+			wantRead:     4,
+			wantErr:      io.EOF,
+		},
+		{
+			name: "attack split across fragments is rejected",
+			frames: [][]byte{
+				wsFrame(false, wsOpText, "att"),
+				wsFrame(true, wsOpContinuation, "ack"),
+			},
+			wantMessages: []string{"attack"},
+			wantErr:      ErrWebSocketViolation,
+		},
+		{
+			name:         "rejected message is never released",
+			frames:       [][]byte{wsFrame(true, wsOpText, "hello"), wsFrame(true, wsOpText, "attack")},
+			wantMessages: []string{"hello", "attack"},
+			wantRead:     1,
+			wantErr:      ErrWebSocketViolation,
+		},
+		{
+			name:    "oversized frame",
+			frames:  [][]byte{wsFrame(true, wsOpBinary, strings.Repeat("x", 17))},
+			wantErr: ErrWebSocketMessageTooLarge,
+		},
+		{
+			name: "oversized fragmented message",
+			frames: [][]byte{
+				wsFrame(false, wsOpText, strings.Repeat("x", 10)),
+				wsFrame(true, wsOpContinuation, strings.Repeat("x", 10)),
+			},
+			wantErr: ErrWebSocketMessageTooLarge,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var messages []string
+			cfg := defaultConfig()
+			WithWebSocketInspector(16, func(payload []byte) bool {
+				messages = append(messages, string(payload))
+				return !strings.Contains(string(payload), "attack")
+			}).apply(cfg)
+
+			server, client := net.Pipe()
+			defer client.Close()
+			conn := &wsConn{
+				Conn:    server,
+				r:       bytes.NewReader(bytes.Join(tc.frames, nil)),
+				inspect: cfg.wsInspector,
+				max:     cfg.wsMaxMessageSize,
+			}
+
+			// Small reads exercise frames split across reads.
+			buf := make([]byte, 3)
+			var (
+				read []byte
+				err  error
+			)
+			for err == nil {
+				var n int
+				n, err = conn.Read(buf)
+				read = append(read, buf[:n]...)
+			}
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("error: got %v, want %v", err, tc.wantErr)
+			}
+			if !slices.Equal(messages, tc.wantMessages) {
+				t.Errorf("messages: got %q, want %q", messages, tc.wantMessages)
+			}
+			if want := bytes.Join(tc.frames[:tc.wantRead], nil); !bytes.Equal(read, want) {
+				t.Errorf("read: got %q, want %q", read, want)
+			}
+		})
+	}
+}
+
+// responseDirectives enables response body inspection of text/plain responses, and blocks responses leaking a header
+// or a secret in their body.
+const responseDirectives = `
+	SecRuleEngine On
+	SecResponseBodyAccess On
+	SecResponseBodyMimeType text/plain
+	SecRule RESPONSE_HEADERS:X-Leak "@streq yes" "id:1,phase:3,deny,status:403"
+	SecRule RESPONSE_BODY "@contains secret" "id:2,phase:4,deny,status:403"
+`
+
+// reply returns a handler replying with a text/plain body, along with the given header values.
+func reply(body string, headers ...string) fox.HandlerFunc {
+	return func(c fox.Context) {
+		for i := 0; i+1 < len(headers); i += 2 {
+			c.Writer().Header().Set(headers[i], headers[i+1])
+		}
+		c.Writer().Header().Set("Content-Type", "text/plain")
+		_, _ = c.Writer().Write([]byte(body))
+	}
+}
+
+func TestWithResponseHeaderInspection(t *testing.T) {
+	waf := newTestWAF(t, responseDirectives)
+
+	cases := []struct {
+		name       string
+		enable     bool
+		handler    fox.HandlerFunc
+		wantStatus int
+	}{
+		{
+			name:       "headers inspected",
+			enable:     true,
+			handler:    reply("hello", "X-Leak", "yes"),
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "headers not inspected",
+			handler:    reply("hello", "X-Leak", "yes"),
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "body still inspected",
+			handler:    reply("secret"),
+			wantStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			w := serve(req, tc.handler, Middleware(waf, WithResponseHeaderInspection(tc.enable)))
+			if w.Code != tc.wantStatus {
+				t.Errorf("status: got %d, want %d", w.Code, tc.wantStatus)
+			}
+		})
+	}
+}
+
+func TestWithResponseRewriter(t *testing.T) {
+	const directives = `
+		SecRuleEngine On
+		SecResponseBodyAccess On
+		SecResponseBodyMimeType text/plain
+		SecResponseBodyLimit 16
+		SecResponseBodyLimitAction %s
+		SecRule RESPONSE_BODY "@contains SECRET" "id:1,phase:4,deny,status:403"
+	`
+	upper := WithResponseRewriter(func(_ string, body []byte) []byte {
+		return bytes.ToUpper(body)
+	})
+
+	cases := []struct {
+		name        string
+		limitAction string
+		opts        []Option
+		body        string
+		wantStatus  int
+		wantBody    string
+	}{
+		{
+			name:        "rewritten body is sent",
+			limitAction: "Reject",
+			body:        "hello",
+			wantStatus:  http.StatusOK,
+			wantBody:    "HELLO",
+		},
+		{
+			name:        "rewritten body is inspected",
+			limitAction: "Reject",
+			body:        "secret",
+			wantStatus:  http.StatusForbidden,
+		},
+		{
+			name:        "body past the spill threshold is sent unmodified",
+			limitAction: "Reject",
+			opts:        []Option{WithResponseBufferSpillToStream(8)},
+			body:        "hello world",
+			wantStatus:  http.StatusOK,
+			wantBody:    "hello world",
+		},
+		{
+			name:        "body past the body limit is rejected",
+			limitAction: "Reject",
+			body:        strings.Repeat("x", 32),
+			wantStatus:  http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:        "body past the body limit is partially processed",
+			limitAction: "ProcessPartial",
+			body:        strings.Repeat("x", 32),
+			wantStatus:  http.StatusOK,
+			wantBody:    strings.Repeat("x", 32),
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			waf := newTestWAF(t, fmt.Sprintf(directives, tc.limitAction))
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			w := serve(req, reply(tc.body), Middleware(waf, append(tc.opts, upper)...))
+			if w.Code != tc.wantStatus {
+				t.Errorf("status: got %d, want %d", w.Code, tc.wantStatus)
+			}
+			if w.Code == http.StatusOK && w.Body.String() != tc.wantBody {
+				t.Errorf("body: got %q, want %q", w.Body.String(), tc.wantBody)
+			}
+		})
+	}
+}
+
+// flushRecorder is a response recorder recording the size of the body sent at each flush.
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushed int
+	chunks  []int
+}
+
+func (r *flushRecorder) Flush() {
+	r.chunks = append(r.chunks, r.Body.Len()-r.flushed)
+	r.flushed = r.Body.Len()
+	r.ResponseRecorder.Flush()
+}
+
+// hijackRecorder is a response recorder whose connection can be hijacked.
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+	conn     net.Conn
+	hijacked bool
+}
+
+func (r *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	r.hijacked = true
+	return r.conn, bufio.NewReadWriter(bufio.NewReader(r.conn), bufio.NewWriter(r.conn)), nil
+}
+
+func TestDropInterruption(t *testing.T) {
+	waf := newTestWAF(t, `
+		SecRuleEngine On
+		SecResponseBodyAccess On
+		SecResponseBodyMimeType text/plain
+		SecRule ARGS:id "@eq 1" "id:1,phase:1,drop"
+		SecRule RESPONSE_BODY "@contains secret" "id:2,phase:4,drop"
+	`)
+
+	cases := []struct {
+		name     string
+		target   string
+		handler  fox.HandlerFunc
+		hijack   bool
+		wantRule int
+	}{
+		{
+			name:     "request dropped without hijacker",
+			target:   "/?id=1",
+			handler:  ok,
+			wantRule: 1,
+		},
+		{
+			name:     "response dropped without hijacker",
+			target:   "/",
+			handler:  reply("a secret"),
+			wantRule: 2,
+		},
+		{
+			name:     "request dropped with hijacker",
+			target:   "/?id=1",
+			handler:  ok,
+			hijack:   true,
+			wantRule: 1,
+		},
+		{
+			name:     "response dropped with hijacker",
+			target:   "/",
+			handler:  reply("a secret"),
+			hijack:   true,
+			wantRule: 2,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var rule int
+			onInterruption := WithOnInterruption(func(c fox.Context, it *types.Interruption, _ types.RulePhase) {
+				rule = it.RuleID
+			})
+			f := fox.New(fox.WithMiddleware(Middleware(waf, onInterruption)))
+			f.MustHandle(http.MethodGet, "/", tc.handler)
+
+			server, client := net.Pipe()
+			defer client.Close()
+			w := &hijackRecorder{ResponseRecorder: httptest.NewRecorder(), conn: server}
+			var rw http.ResponseWriter = w.ResponseRecorder
+			if tc.hijack {
+				rw = w
+			}
+			f.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, tc.target, nil))
+
+			if rule != tc.wantRule {
+				t.Errorf("rule: got %d, want %d", rule, tc.wantRule)
+			}
+			if w.Body.Len() != 0 {
+				t.Errorf("body: got %q, want empty", w.Body.String())
+			}
+			if !tc.hijack {
+				if w.Code != statusNoResponse {
+					t.Errorf("status: got %d, want %d", w.Code, statusNoResponse)
+				}
+				if got := w.Header().Get("Content-Length"); got != "0" {
+					t.Errorf("Content-Length: got %q, want %q", got, "0")
+				}
+				return
+			}
+			if !w.hijacked {
+				t.Fatal("the connection was not hijacked")
+			}
+			// The connection is closed without any response.
+			_ = client.SetReadDeadline(time.Now().Add(time.Second))
+			if n, err := client.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+				t.Errorf("read: got %d, %v, want 0, EOF", n, err)
+			}
+		})
+	}
+}
+
+func TestWithChunkedFlush(t *testing.T) {
+	waf := newTestWAF(t, responseDirectives)
+
+	cases := []struct {
+		name       string
+		size       int
+		body       string
+		wantChunks []int
+	}{
+		{
+			name:       "body sent in chunks",
+			size:       4,
+			body:       "hello world",
+			wantChunks: []int{4, 4, 3},
+		},
+		{
+			name:       "body sent in a single chunk",
+			size:       16,
+			body:       "hello world",
+			wantChunks: []int{11},
+		},
+		{
+			name: "body sent at once",
+			body: "hello world",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			f := fox.New(fox.WithMiddleware(Middleware(waf, WithChunkedFlush(tc.size))))
+			f.MustHandle(http.MethodGet, "/", reply(tc.body))
+			w := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+			f.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+			if w.Body.String() != tc.body {
+				t.Errorf("body: got %q, want %q", w.Body.String(), tc.body)
+			}
+			if !slices.Equal(w.chunks, tc.wantChunks) {
+				t.Errorf("chunks: got %v, want %v", w.chunks, tc.wantChunks)
+			}
+		})
+	}
+}
+
+func TestFlushError(t *testing.T) {
+	waf := newTestWAF(t, responseDirectives)
+
+	writerFlush := func(c fox.Context) error { return c.Writer().FlushError() }
+	// http.ResponseController is how net/http handlers flush a writer, and it reports FlushError errors.
+	controllerFlush := func(c fox.Context) error { return http.NewResponseController(c.Writer()).Flush() }
+
+	cases := []struct {
+		name          string
+		contentType   string
+		second        string
+		flush         func(c fox.Context) error
+		wantErr       error
+		wantFlushed   string
+		wantStatus    int
+		wantBody      string
+		wantFlushCall bool
+	}{
+		{
+			name:        "inspected body stays held",
+			contentType: "text/plain",
+			second:      "world",
+			flush:       writerFlush,
+			wantErr:     ErrFlushPendingInspection,
+			wantStatus:  http.StatusOK,
+			wantBody:    "hello world",
+		},
+		{
+			name:        "inspected body stays held with a response controller",
+			contentType: "text/plain",
+			second:      "world",
+			flush:       controllerFlush,
+			wantErr:     ErrFlushPendingInspection,
+			wantStatus:  http.StatusOK,
+			wantBody:    "hello world",
+		},
+		{
+			name:        "held body never leaks once blocked",
+			contentType: "text/plain",
+			second:      "secret",
+			flush:       writerFlush,
+			wantErr:     ErrFlushPendingInspection,
+			wantStatus:  http.StatusForbidden,
+		},
+		{
+			name:          "uninspected body is flushed",
+			contentType:   "application/octet-stream",
+			second:        "world",
+			flush:         writerFlush,
+			wantFlushed:   "hello ",
+			wantStatus:    http.StatusOK,
+			wantBody:      "hello world",
+			wantFlushCall: true,
+		},
+		{
+			name:          "uninspected body is flushed with a response controller",
+			contentType:   "application/octet-stream",
+			second:        "world",
+			flush:         controllerFlush,
+			wantFlushed:   "hello ",
+			wantStatus:    http.StatusOK,
+			wantBody:      "hello world",
+			wantFlushCall: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+			var (
+				err     error
+				flushed string
+			)
+			f := fox.New(fox.WithMiddleware(Middleware(waf)))
+			f.MustHandle(http.MethodGet, "/", func(c fox.Context) {
+				c.Writer().Header().Set("Content-Type", tc.contentType)
+				_, _ = c.Writer().Write([]byte("hello "))
+				err = tc.flush(c)
+				flushed = w.Body.String()
+				_, _ = c.Writer().Write([]byte(tc.second))
+			})
+			f.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("error: got %v, want %v", err, tc.wantErr)
+			}
+			if flushed != tc.wantFlushed {
+				t.Errorf("flushed: got %q, want %q", flushed, tc.wantFlushed)
+			}
+			if got := len(w.chunks) > 0; got != tc.wantFlushCall {
+				t.Errorf("flush forwarded: got %t, want %t", got, tc.wantFlushCall)
+			}
+			if w.Code != tc.wantStatus {
+				t.Errorf("status: got %d, want %d", w.Code, tc.wantStatus)
+			}
+			if w.Code == http.StatusOK && w.Body.String() != tc.wantBody {
+				t.Errorf("body: got %q, want %q", w.Body.String(), tc.wantBody)
+			}
+			if strings.Contains(w.Body.String(), "hello") && w.Code != http.StatusOK {
+				t.Errorf("body: got %q, the held body leaked", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestServeContent(t *testing.T) {
+	waf := newTestWAF(t, responseDirectives)
+
+	modTime := time.Date(2024, 7, 15, 0, 0, 0, 0, time.UTC)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "file.txt"), []byte("hello secret world"), 0o600); err != nil {
+		t.Fatalf("failed to write the file: %v", err)
+	}
+	serveContent := func(content string) fox.HandlerFunc {
+		return func(c fox.Context) {
+			c.Writer().Header().Set("Content-Type", "text/plain")
+			http.ServeContent(c.Writer(), c.Request(), "file.txt", modTime, strings.NewReader(content))
+		}
+	}
+	serveFile := func(c fox.Context) {
+		http.ServeFile(c.Writer(), c.Request(), filepath.Join(dir, "file.txt"))
+	}
+
+	cases := []struct {
+		name             string
+		handler          fox.HandlerFunc
+		header           []string
+		wantStatus       int
+		wantBody         string
+		wantContentRange string
+	}{
+		{
+			name:       "full content inspected",
+			handler:    serveContent("hello world"),
+			wantStatus: http.StatusOK,
+			wantBody:   "hello world",
+		},
+		{
+			name:       "full content blocked",
+			handler:    serveContent("hello secret world"),
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "full file blocked",
+			handler:    serveFile,
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:             "range passed through",
+			handler:          serveContent("hello secret world"),
+			header:           []string{"Range", "bytes=6-11"},
+			wantStatus:       http.StatusPartialContent,
+			wantBody:         "secret",
+			wantContentRange: "bytes 6-11/18",
+		},
+		{
+			name:             "file range passed through",
+			handler:          serveFile,
+			header:           []string{"Range", "bytes=0-4"},
+			wantStatus:       http.StatusPartialContent,
+			wantBody:         "hello",
+			wantContentRange: "bytes 0-4/18",
+		},
+		{
+			name:       "not modified",
+			handler:    serveContent("hello secret world"),
+			header:     []string{"If-Modified-Since", modTime.Format(http.TimeFormat)},
+			wantStatus: http.StatusNotModified,
+		},
+		{
+			name: "not modified headers inspected",
+			handler: func(c fox.Context) {
+				c.Writer().Header().Set("X-Leak", "yes")
+				serveContent("hello world")(c)
+			},
+			header:     []string{"If-Modified-Since", modTime.Format(http.TimeFormat)},
+			wantStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/file.txt", nil)
+			for i := 0; i+1 < len(tc.header); i += 2 {
+				req.Header.Set(tc.header[i], tc.header[i+1])
+			}
+			w := serve(req, tc.handler, Middleware(waf))
+			if w.Code != tc.wantStatus {
+				t.Errorf("status: got %d, want %d", w.Code, tc.wantStatus)
+			}
+			if w.Code == http.StatusForbidden {
+				return
+			}
+			if w.Body.String() != tc.wantBody {
+				t.Errorf("body: got %q, want %q", w.Body.String(), tc.wantBody)
+			}
+			if got := w.Header().Get("Content-Range"); got != tc.wantContentRange {
+				t.Errorf("Content-Range: got %q, want %q", got, tc.wantContentRange)
+			}
+			if tc.wantBody != "" {
+				if got, want := w.Header().Get("Content-Length"), strconv.Itoa(len(tc.wantBody)); got != want {
+					t.Errorf("Content-Length: got %q, want %q", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestWithoutInterceptorPool(t *testing.T) {
+	waf := newTestWAF(t, responseDirectives)
+
+	cases := []struct {
+		name string
+		opts []Option
+	}{
+		{
+			name: "pooled interceptors",
+		},
+		{
+			name: "fresh interceptors",
+			opts: []Option{WithoutInterceptorPool()},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			f := fox.New(fox.WithMiddleware(Middleware(waf, tc.opts...)))
+			f.MustHandle(http.MethodGet, "/secret", reply("secret"))
+			f.MustHandle(http.MethodGet, "/hello", reply("hello"))
+
+			// An interrupted response must not leak into the next one.
+			for _, want := range []struct {
+				path   string
+				status int
+				body   string
+			}{
+				{"/secret", http.StatusForbidden, ""},
+				{"/hello", http.StatusOK, "hello"},
+				{"/secret", http.StatusForbidden, ""},
+			} {
+				w := httptest.NewRecorder()
+				f.ServeHTTP(w, httptest.NewRequest(http.MethodGet, want.path, nil))
+				if w.Code != want.status {
+					t.Errorf("%s status: got %d, want %d", want.path, w.Code, want.status)
+				}
+				if w.Body.String() != want.body {
+					t.Errorf("%s body: got %q, want %q", want.path, w.Body.String(), want.body)
+				}
+			}
+		})
+	}
+}
+
+func TestWithServerTimingHeader(t *testing.T) {
+	waf := newTestWAF(t, responseDirectives+`
+	SecRule REQUEST_URI "@contains attack" "id:3,phase:1,deny,status:403"
+`)
+
+	cases := []struct {
+		name       string
+		enable     bool
+		path       string
+		handler    fox.HandlerFunc
+		wantStatus int
+		wantTiming *regexp.Regexp
+	}{
+		{
+			name:       "inspected response",
+			enable:     true,
+			path:       "/",
+			handler:    reply("hello"),
+			wantStatus: http.StatusOK,
+			wantTiming: regexp.MustCompile(`^waf-req;dur=\d+\.\d{3}, waf-resp;dur=\d+\.\d{3}$`),
+		},
+		{
+			name:   "streamed response",
+			enable: true,
+			path:   "/",
+			handler: func(c fox.Context) {
+				c.Writer().Header().Set("Content-Type", "application/octet-stream")
+				_, _ = c.Writer().Write([]byte("hello"))
+			},
+			wantStatus: http.StatusOK,
+			wantTiming: regexp.MustCompile(`^waf-req;dur=\d+\.\d{3}$`),
+		},
+		{
+			name:       "blocked request",
+			enable:     true,
+			path:       "/attack",
+			handler:    ok,
+			wantStatus: http.StatusForbidden,
+			wantTiming: regexp.MustCompile(`^waf-req;dur=\d+\.\d{3}$`),
+		},
+		{
+			name:       "disabled",
+			path:       "/",
+			handler:    reply("hello"),
+			wantStatus: http.StatusOK,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			w := serve(req, tc.handler, Middleware(waf, WithServerTimingHeader(tc.enable)))
+			if w.Code != tc.wantStatus {
+				t.Errorf("status: got %d, want %d", w.Code, tc.wantStatus)
+			}
+			got := w.Header().Get("Server-Timing")
+			if tc.wantTiming == nil {
+				if got != "" {
+					t.Errorf("Server-Timing: got %q, want none", got)
+				}
+				return
+			}
+			if !tc.wantTiming.MatchString(got) {
+				t.Errorf("Server-Timing: got %q, want match for %s", got, tc.wantTiming)
+			}
+		})
+	}
+}
+
+func TestWithResponsePrefixInspection(t *testing.T) {
+	waf := newTestWAF(t, responseDirectives)
+
+	cases := []struct {
+		name       string
+		chunks     []string
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "secret in the prefix",
+			chunks:     []string{"the secret is out"},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "secret past the prefix",
+			chunks:     []string{"nothing to see here, the secret is out"},
+			wantStatus: http.StatusOK,
+			wantBody:   "nothing to see here, the secret is out",
+		},
+		{
+			name:       "prefix completed across writes",
+			chunks:     []string{"nothing ", "to see", " here, the secret", " is out"},
+			wantStatus: http.StatusOK,
+			wantBody:   "nothing to see here, the secret is out",
+		},
+		{
+			name:       "body shorter than the prefix",
+			chunks:     []string{"secret"},
+			wantStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			h := func(c fox.Context) {
+				c.Writer().Header().Set("Content-Type", "text/plain")
+				for _, chunk := range tc.chunks {
+					_, _ = c.Writer().Write([]byte(chunk))
+				}
+			}
+			w := serve(httptest.NewRequest(http.MethodGet, "/", nil), h, Middleware(waf, WithResponsePrefixInspection(16)))
+			if w.Code != tc.wantStatus {
+				t.Errorf("status: got %d, want %d", w.Code, tc.wantStatus)
+			}
+			if tc.wantStatus == http.StatusOK && w.Body.String() != tc.wantBody {
+				t.Errorf("body: got %q, want %q", w.Body.String(), tc.wantBody)
+			}
+		})
+	}
+}
+
+func TestWithResponseBufferSpillToStream(t *testing.T) {
+	waf := newTestWAF(t, responseDirectives)
+
+	cases := []struct {
+		name          string
+		chunks        []string
+		wantStatus    int
+		wantBody      string
+		wantInspected bool
+		wantReason    string
+	}{
+		{
+			name:          "body under the threshold",
+			chunks:        []string{"secret"},
+			wantStatus:    http.StatusForbidden,
+			wantInspected: true,
+		},
+		{
+			name:       "body over the threshold",
+			chunks:     []string{"this body leaks a secret"},
+			wantStatus: http.StatusOK,
+			wantBody:   "this body leaks a secret",
+			wantReason: reasonSpilled,
+		},
+		{
+			name:       "buffered bytes sent uninspected",
+			chunks:     []string{"a secret", " spilled past the threshold"},
+			wantStatus: http.StatusOK,
+			wantBody:   "a secret spilled past the threshold",
+			wantReason: reasonSpilled,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				inspected bool
+				reason    string
+			)
+			h := func(c fox.Context) {
+				c.Writer().Header().Set("Content-Type", "text/plain")
+				for _, chunk := range tc.chunks {
+					_, _ = c.Writer().Write([]byte(chunk))
+				}
+			}
+			mw := Middleware(waf,
+				WithResponseBufferSpillToStream(16),
+				WithFinalStatus(func(c fox.Context, status int, interrupted bool) {
+					inspected, reason = ResponseInspected(c)
+				}),
+			)
+			w := serve(httptest.NewRequest(http.MethodGet, "/", nil), h, mw)
+			if w.Code != tc.wantStatus {
+				t.Errorf("status: got %d, want %d", w.Code, tc.wantStatus)
+			}
+			if tc.wantStatus == http.StatusOK && w.Body.String() != tc.wantBody {
+				t.Errorf("body: got %q, want %q", w.Body.String(), tc.wantBody)
+			}
+			if inspected != tc.wantInspected || reason != tc.wantReason {
+				t.Errorf("inspection: got %t %q, want %t %q", inspected, reason, tc.wantInspected, tc.wantReason)
+			}
+		})
+	}
+}
+
+// failingWAF is a Coraza WAF whose transactions fail to process the response body.
+type failingWAF struct {
+	coraza.WAF
+}
+
+func (w failingWAF) NewTransaction() types.Transaction {
+	return failingTX{w.WAF.NewTransaction()}
+}
+
+type failingTX struct {
+	types.Transaction
+}
+
+func (failingTX) ProcessResponseBody() (*types.Interruption, error) {
+	return nil, errors.New("response body processing failure")
+}
+
+func TestWithResponseErrorBody(t *testing.T) {
+	waf := failingWAF{newTestWAF(t, responseDirectives)}
+
+	cases := []struct {
+		name            string
+		opts            []Option
+		wantBody        string
+		wantContentType string
+	}{
+		{
+			name: "empty body by default",
+		},
+		{
+			name:            "custom body",
+			opts:            []Option{WithResponseErrorBody([]byte(`{"error":"internal"}`), "application/json")},
+			wantBody:        `{"error":"internal"}`,
+			wantContentType: "application/json",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var handlerErr error
+			opts := append([]Option{WithErrorHandler(func(c fox.Context, err error) {
+				handlerErr = err
+			})}, tc.opts...)
+			w := serve(httptest.NewRequest(http.MethodGet, "/", nil), reply("hello", "X-App", "yes"), Middleware(waf, opts...))
+			if w.Code != http.StatusInternalServerError {
+				t.Errorf("status: got %d, want %d", w.Code, http.StatusInternalServerError)
+			}
+			if w.Body.String() != tc.wantBody {
+				t.Errorf("body: got %q, want %q", w.Body.String(), tc.wantBody)
+			}
+			if got := w.Header().Get("Content-Type"); got != tc.wantContentType {
+				t.Errorf("Content-Type: got %q, want %q", got, tc.wantContentType)
+			}
+			if w.Header().Get("X-App") != "" {
+				t.Error("the handler headers must be removed")
+			}
+			if handlerErr == nil {
+				t.Error("the error handler must observe the failure")
+			}
+		})
+	}
+}
+
+func TestWithBlockBody(t *testing.T) {
+	waf := newTestWAF(t, responseDirectives+`
+	SecRule REQUEST_URI "@contains attack" "id:3,phase:1,deny,status:403"
+`)
+	const blockBody = `{"error":"blocked"}`
+
+	cases := []struct {
+		name       string
+		target     string
+		remoteAddr string
+		h          fox.HandlerFunc
+	}{
+		{
+			name:       "denylist",
+			target:     "/",
+			remoteAddr: "192.0.2.1:1234",
+			h:          reply("hello"),
+		},
+		{
+			name:   "request phase",
+			target: "/?q=attack",
+			h:      reply("hello"),
+		},
+		{
+			name:   "response headers phase",
+			target: "/",
+			h:      reply("hello", "X-Leak", "yes"),
+		},
+		{
+			name:   "response body phase",
+			target: "/",
+			h:      reply("a secret"),
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			mw := Middleware(waf,
+				WithBlockBody([]byte(blockBody), "application/json"),
+				WithIPDenylist([]netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}, 0),
+			)
+			req := httptest.NewRequest(http.MethodGet, tc.target, nil)
+			if tc.remoteAddr != "" {
+				req.RemoteAddr = tc.remoteAddr
+			}
+			w := serve(req, tc.h, mw)
+			if w.Code != http.StatusForbidden {
+				t.Errorf("status: got %d, want %d", w.Code, http.StatusForbidden)
+			}
+			if w.Body.String() != blockBody {
+				t.Errorf("body: got %q, want %q", w.Body.String(), blockBody)
+			}
+			if got := w.Header().Get("Content-Type"); got != "application/json" {
+				t.Errorf("Content-Type: got %q, want %q", got, "application/json")
+			}
+			if got, want := w.Header().Get("Content-Length"), strconv.Itoa(len(blockBody)); got != want {
+				t.Errorf("Content-Length: got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestPutInterceptor(t *testing.T) {
+	cases := []struct {
+		name     string
+		size     int
+		wantKept bool
+	}{
+		{
+			name:     "small held buffer",
+			size:     1024,
+			wantKept: true,
+		},
+		{
+			name: "oversized held buffer",
+			size: maxHeldBufferSize + 1,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := &rwInterceptor{}
+			w.held.Grow(tc.size)
+			putInterceptor(w)
+			if kept := w.held.Cap() > 0; kept != tc.wantKept {
+				t.Errorf("held buffer kept: got %t, want %t", kept, tc.wantKept)
+			}
+		})
+	}
+}
+
+func TestWithVerdictTrailer(t *testing.T) {
+	waf := newTestWAF(t, responseDirectives+`
+	SecRule RESPONSE_HEADERS:X-Late "@streq yes" "id:3,phase:4,deny,status:403"
+`)
+
+	cases := []struct {
+		name        string
+		h           fox.HandlerFunc
+		wantVerdict string
+	}{
+		{
+			name:        "inspected response",
+			h:           reply("hello"),
+			wantVerdict: "pass",
+		},
+		{
+			name: "streamed response",
+			h: func(c fox.Context) {
+				c.Writer().Header().Set("Content-Type", "application/octet-stream")
+				_, _ = c.Writer().Write([]byte("hello"))
+			},
+			wantVerdict: "pass",
+		},
+		{
+			name: "streamed response interrupted after being sent",
+			h: func(c fox.Context) {
+				c.Writer().Header().Set("Content-Type", "application/octet-stream")
+				c.Writer().Header().Set("X-Late", "yes")
+				_, _ = c.Writer().Write([]byte("hello"))
+			},
+			wantVerdict: "detected",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var interrupted bool
+			mw := Middleware(waf,
+				WithVerdictTrailer(true),
+				WithFinalStatus(func(c fox.Context, status int, i bool) {
+					interrupted = i
+				}),
+			)
+			w := serve(httptest.NewRequest(http.MethodGet, "/", nil), tc.h, mw)
+			if w.Code != http.StatusOK {
+				t.Errorf("status: got %d, want %d", w.Code, http.StatusOK)
+			}
+			if w.Body.String() != "hello" {
+				t.Errorf("body: got %q, want %q", w.Body.String(), "hello")
+			}
+			if got := w.Result().Trailer.Get(headerVerdict); got != tc.wantVerdict {
+				t.Errorf("verdict: got %q, want %q", got, tc.wantVerdict)
+			}
+			if interrupted {
+				t.Error("a detected interruption must not be reported as enforced")
+			}
+		})
+	}
+}
+
+func TestSniffedContentType(t *testing.T) {
+	waf := newTestWAF(t, `
+		SecRuleEngine On
+		SecResponseBodyAccess On
+		SecResponseBodyMimeType text/html
+		SecRule RESPONSE_BODY "@contains secret" "id:1,phase:4,deny,status:403"
+	`)
+	const page = "<html><body>a secret</body></html>"
+
+	cases := []struct {
+		name            string
+		h               fox.HandlerFunc
+		wantStatus      int
+		wantContentType string
+	}{
+		{
+			name: "write only",
+			h: func(c fox.Context) {
+				_, _ = c.Writer().Write([]byte(page))
+			},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name: "write header then write",
+			h: func(c fox.Context) {
+				c.Writer().WriteHeader(http.StatusOK)
+				_, _ = c.Writer().Write([]byte(page))
+			},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name: "write header then write a clean page",
+			h: func(c fox.Context) {
+				c.Writer().WriteHeader(http.StatusCreated)
+				_, _ = c.Writer().Write([]byte("<html><body>hello</body></html>"))
+			},
+			wantStatus:      http.StatusCreated,
+			wantContentType: "text/html; charset=utf-8",
+		},
+		{
+			name: "write header without body",
+			h: func(c fox.Context) {
+				c.Writer().WriteHeader(http.StatusAccepted)
+			},
+			wantStatus: http.StatusAccepted,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := serve(httptest.NewRequest(http.MethodGet, "/", nil), tc.h, Middleware(waf))
+			if w.Code != tc.wantStatus {
+				t.Errorf("status: got %d, want %d", w.Code, tc.wantStatus)
+			}
+			if strings.Contains(w.Body.String(), "secret") {
+				t.Error("the blocked body must not reach the client")
+			}
+			if got := w.Header().Get("Content-Type"); got != tc.wantContentType {
+				t.Errorf("Content-Type: got %q, want %q", got, tc.wantContentType)
+			}
+		})
+	}
+}
+
+func TestWithResponseBodyLimit(t *testing.T) {
+	waf := newTestWAF(t, `
+		SecRuleEngine On
+		SecResponseBodyAccess On
+		SecResponseBodyMimeType text/plain
+		SecResponseBodyLimit 64
+		SecResponseBodyLimitAction ProcessPartial
+		SecRule RESPONSE_BODY "@contains secret" "id:1,phase:4,deny,status:403"
+	`)
+	mw := Middleware(waf, WithResponseBodyLimit(func(c fox.Context) int64 {
+		if strings.HasPrefix(c.Route().Pattern(), "/api/") {
+			return 0
+		}
+		return 16
+	}))
+	f := fox.New(fox.WithMiddleware(mw))
+	body := strings.Repeat("a", 32) + " secret"
+	f.MustHandle(http.MethodGet, "/api/users", reply(body))
+	f.MustHandle(http.MethodGet, "/static/page", reply(body))
+
+	cases := []struct {
+		name       string
+		path       string
+		wantStatus int
+	}{
+		{
+			name:       "route inspecting the larger body",
+			path:       "/api/users",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "route with a lowered limit",
+			path:       "/static/page",
+			wantStatus: http.StatusOK,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			f.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.path, nil))
+			if w.Code != tc.wantStatus {
+				t.Errorf("status: got %d, want %d", w.Code, tc.wantStatus)
+			}
+		})
+	}
+}
+
+func TestWithStripResponseHeaders(t *testing.T) {
+	waf := newTestWAF(t, responseDirectives+`
+	SecRule REQUEST_URI "@contains attack" "id:3,phase:1,deny,status:403"
+	SecRule RESPONSE_HEADERS:X-Powered-By "@streq php" "id:4,phase:3,deny,status:403"
+`)
+	offWAF := newTestWAF(t, "SecRuleEngine Off")
+	prefixes := []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}
+	// upstream sets a header before the WAF, which applies as well to the responses written by the WAF itself.
+	upstream := func(next fox.HandlerFunc) fox.HandlerFunc {
+		return func(c fox.Context) {
+			c.Writer().Header().Set("Server", "fox")
+			next(c)
+		}
+	}
+
+	cases := []struct {
+		name       string
+		waf        coraza.WAF
+		opts       []Option
+		target     string
+		remoteAddr string
+		h          fox.HandlerFunc
+		wantStatus int
+	}{
+		{
+			name:       "inspected response",
+			waf:        waf,
+			target:     "/",
+			h:          reply("hello", "X-Powered-By", "go"),
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "response headers rule still sees the header",
+			waf:        waf,
+			target:     "/",
+			h:          reply("hello", "X-Powered-By", "php"),
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "rule engine off",
+			waf:        offWAF,
+			target:     "/",
+			h:          reply("hello", "X-Powered-By", "go"),
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "allowlisted client",
+			waf:        waf,
+			opts:       []Option{WithIPAllowlist(prefixes)},
+			target:     "/",
+			remoteAddr: "192.0.2.1:1234",
+			h:          reply("hello", "X-Powered-By", "go"),
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "unsampled request",
+			waf:        waf,
+			opts:       []Option{WithRequestSampling(0)},
+			target:     "/",
+			h:          reply("hello", "X-Powered-By", "go"),
+			wantStatus: http.StatusOK,
+		},
+		{
+			name: "skipped request",
+			waf:  waf,
+			opts: []Option{WithSkipper(func(c fox.Context) bool {
+				return true
+			})},
+			target:     "/",
+			h:          reply("hello", "X-Powered-By", "go"),
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "transaction failure failing open",
+			waf:        brokenWAF{},
+			target:     "/",
+			h:          reply("hello", "X-Powered-By", "go"),
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "transaction failure failing closed",
+			waf:        brokenWAF{},
+			opts:       []Option{WithFailClosed(true)},
+			target:     "/",
+			h:          reply("hello", "X-Powered-By", "go"),
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name:       "denied client",
+			waf:        waf,
+			opts:       []Option{WithIPDenylist(prefixes, 0)},
+			target:     "/",
+			remoteAddr: "192.0.2.1:1234",
+			h:          reply("hello", "X-Powered-By", "go"),
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "request blocked",
+			waf:        waf,
+			target:     "/?q=attack",
+			h:          reply("hello", "X-Powered-By", "go"),
+			wantStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := append([]Option{WithStripResponseHeaders("Server", "x-powered-by")}, tc.opts...)
+			req := httptest.NewRequest(http.MethodGet, tc.target, nil)
+			if tc.remoteAddr != "" {
+				req.RemoteAddr = tc.remoteAddr
+			}
+			w := serve(req, tc.h, upstream, Middleware(tc.waf, opts...))
+			if w.Code != tc.wantStatus {
+				t.Errorf("status: got %d, want %d", w.Code, tc.wantStatus)
+			}
+			for _, name := range []string{"Server", "X-Powered-By"} {
+				if got := w.Header().Get(name); got != "" {
+					t.Errorf("%s: got %q, want it stripped", name, got)
+				}
+			}
+		})
+	}
+}
+
+func TestWithOnInterruption(t *testing.T) {
+	waf := newTestWAF(t, responseDirectives+`
+	SecRequestBodyAccess On
+	SecAction "id:3,phase:1,pass,nolog,ctl:forceRequestBodyVariable=on"
+	SecRule REQUEST_URI "@contains attack" "id:4,phase:1,deny,status:403"
+	SecRule REQUEST_BODY "@contains attack" "id:5,phase:2,deny,status:403"
+`)
+
+	type call struct {
+		ruleID int
+		phase  types.RulePhase
+	}
+	cases := []struct {
+		name      string
+		opts      []Option
+		target    string
+		body      string
+		h         fox.HandlerFunc
+		wantCalls []call
+	}{
+		{
+			name:      "request headers",
+			target:    "/?q=attack",
+			h:         reply("hello"),
+			wantCalls: []call{{4, types.PhaseRequestHeaders}},
+		},
+		{
+			name:      "request body",
+			target:    "/",
+			body:      "attack",
+			h:         reply("hello"),
+			wantCalls: []call{{5, types.PhaseRequestBody}},
+		},
+		{
+			name:      "response headers",
+			target:    "/",
+			h:         reply("hello", "X-Leak", "yes"),
+			wantCalls: []call{{1, types.PhaseResponseHeaders}},
+		},
+		{
+			name:      "response body",
+			target:    "/",
+			h:         reply("a secret"),
+			wantCalls: []call{{2, types.PhaseResponseBody}},
+		},
+		{
+			name:   "response body written in several chunks",
+			target: "/",
+			h: func(c fox.Context) {
+				c.Writer().Header().Set("Content-Type", "text/plain")
+				_, _ = c.Writer().Write([]byte("a secret"))
+				_, _ = c.Writer().Write([]byte("another secret"))
+			},
+			wantCalls: []call{{2, types.PhaseResponseBody}},
+		},
+		{
+			name:      "response body prefix",
+			opts:      []Option{WithResponsePrefixInspection(8)},
+			target:    "/",
+			h:         reply("a secret and more"),
+			wantCalls: []call{{2, types.PhaseResponseBody}},
+		},
+		{
+			name:      "held response body",
+			opts:      []Option{WithResponseRewriter(func(contentType string, body []byte) []byte { return body })},
+			target:    "/",
+			h:         reply("a secret"),
+			wantCalls: []call{{2, types.PhaseResponseBody}},
+		},
+		{
+			name:   "clean response",
+			target: "/",
+			h:      reply("hello"),
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var calls []call
+			opts := append([]Option{WithOnInterruption(func(c fox.Context, it *types.Interruption, phase types.RulePhase) {
+				calls = append(calls, call{it.RuleID, phase})
+			})}, tc.opts...)
+			method := http.MethodGet
+			if tc.body != "" {
+				method = http.MethodPost
+			}
+			req := httptest.NewRequest(method, tc.target, strings.NewReader(tc.body))
+			serve(req, tc.h, Middleware(waf, opts...))
+			if !slices.Equal(calls, tc.wantCalls) {
+				t.Errorf("calls: got %+v, want %+v", calls, tc.wantCalls)
+			}
+		})
+	}
+}